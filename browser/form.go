@@ -0,0 +1,397 @@
+package browser
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// FormSelector picks the form to submit from a page that may contain several forms (e.g. a login form next to a
+// search or language form). A form must match the selector (when set) and contain all of the given fields. When
+// neither is set, the first form with a password field is picked, or else the first form.
+type FormSelector struct {
+	// Simple CSS selector: '#id', '.class' or '[attribute=value]', optionally prefixed with 'form'.
+	Selector string
+	Fields   []string
+}
+
+// Form is a form found in a page, with its action resolved against the page URL the way a browser does.
+type Form struct {
+	Method string
+	Action string
+	Fields []Field
+}
+
+type Field struct {
+	Type  string
+	Name  string
+	Value string
+
+	// For checkboxes and radio buttons: whether the control is checked. For submit buttons: whether the form is
+	// submitted with this button.
+	Checked  bool
+	Disabled bool
+}
+
+// Form returns the form in the page that matches the selector.
+func (p *Page) Form(selector FormSelector) (*Form, error) {
+	root, err := p.document()
+	if err != nil {
+		return nil, err
+	}
+
+	// Find form html node.
+	formNode := findForm(root, selector)
+	if formNode == nil {
+		return nil, errors.New("No matching form found in page " + p.URL.String())
+	}
+	return newForm(formNode, p.URL, p.BaseURL())
+}
+
+// Forms returns all forms in the page.
+func (p *Page) Forms() ([]*Form, error) {
+	root, err := p.document()
+	if err != nil {
+		return nil, err
+	}
+
+	var forms []*Form
+	for _, formNode := range findForms(root) {
+		form, err := newForm(formNode, p.URL, p.BaseURL())
+		if err != nil {
+			return nil, err
+		}
+		forms = append(forms, form)
+	}
+	return forms, nil
+}
+
+func newForm(formNode *html.Node, pageURL, baseURL *url.URL) (*Form, error) {
+	// Get relevant attributes from form. A form without method is submitted using GET.
+	form := &Form{Method: http.MethodGet}
+	if method := strings.TrimSpace(attribute(formNode, "method")); method != "" {
+		form.Method = strings.ToUpper(method)
+	}
+	actionURL, err := resolveFormAction(pageURL, baseURL, attribute(formNode, "action"))
+	if err != nil {
+		return nil, err
+	}
+	form.Action = actionURL.String()
+	form.Fields = findInputs(formNode)
+	return form, nil
+}
+
+// Has reports whether the form has a field with the given name.
+func (f *Form) Has(name string) bool {
+	return hasFields(f.Fields, []string{name})
+}
+
+// Get returns the value of the first field with the given name.
+func (f *Form) Get(name string) string {
+	for _, field := range f.Fields {
+		if field.Name == name {
+			return field.Value
+		}
+	}
+	return ""
+}
+
+// Set sets the value of all fields with the given name.
+func (f *Form) Set(name, value string) {
+	for i := range f.Fields {
+		if f.Fields[i].Name == name {
+			f.Fields[i].Value = value
+		}
+	}
+}
+
+// Check checks or unchecks the checkbox (or radio button) with the given name and value. An empty value matches any
+// value. Radio buttons with the same name allow a single selection: checking one unchecks the others, and an empty
+// value checks the first one.
+func (f *Form) Check(name, value string, checked bool) {
+	radio := -1
+	for i, field := range f.Fields {
+		if field.Type == "radio" && field.Name == name && (value == "" || field.Value == value) {
+			radio = i
+			break
+		}
+	}
+	for i := range f.Fields {
+		field := &f.Fields[i]
+		if field.Name != name {
+			continue
+		}
+		if field.Type == "radio" && checked {
+			if radio != -1 {
+				field.Checked = i == radio
+			}
+		} else if value == "" || field.Value == value {
+			field.Checked = checked
+		}
+	}
+}
+
+// Click marks the submit button with the given name and value as the one the form is submitted with. The form is left
+// as is when it has no such button.
+func (f *Form) Click(name, value string) error {
+	clicked := -1
+	for i, field := range f.Fields {
+		if isSubmitButton(field) && field.Name == name && field.Value == value {
+			clicked = i
+			break
+		}
+	}
+	if clicked == -1 {
+		return errors.New("No submit button " + name + "=" + value + " in form")
+	}
+	for i := range f.Fields {
+		if isSubmitButton(f.Fields[i]) {
+			f.Fields[i].Checked = i == clicked
+		}
+	}
+	return nil
+}
+
+// Values returns the form data set that a browser submits: named, enabled controls, only checked checkboxes and
+// radio buttons, and only the submit button the form is submitted with (the first one, unless another one was
+// clicked).
+func (f *Form) Values() url.Values {
+	submitter := -1
+	for i, field := range f.Fields {
+		if isSubmitButton(field) && !field.Disabled && (submitter == -1 || field.Checked) {
+			submitter = i
+			if field.Checked {
+				break
+			}
+		}
+	}
+
+	values := url.Values{}
+	for i, field := range f.Fields {
+		if field.Name == "" || field.Disabled {
+			continue
+		}
+		switch {
+		case isSubmitButton(field):
+			if i != submitter {
+				continue
+			}
+		case field.Type == "checkbox" || field.Type == "radio":
+			if !field.Checked {
+				continue
+			}
+		case field.Type == "reset" || field.Type == "button" || field.Type == "file":
+			continue
+		}
+		values.Add(field.Name, field.Value)
+	}
+	return values
+}
+
+// Request creates the request that submits the form.
+func (f *Form) Request() (*http.Request, error) {
+	values := f.Values()
+	if f.Method == http.MethodGet {
+		actionURL, err := url.Parse(f.Action)
+		if err != nil {
+			return nil, err
+		}
+		actionURL.RawQuery = values.Encode()
+		return http.NewRequest(http.MethodGet, actionURL.String(), nil)
+	}
+
+	request, err := http.NewRequest(f.Method, f.Action, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	return request, nil
+}
+
+// hiddenOnly reports whether the form only has hidden fields (and buttons), i.e. it is not meant to be filled in.
+func (f *Form) hiddenOnly() bool {
+	for _, field := range f.Fields {
+		switch field.Type {
+		case "hidden", "submit", "image", "button", "reset":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// resolveFormAction resolves the action of a form the way a browser does: an empty action submits to the page
+// itself, anything else (relative, absolute or protocol-relative) is resolved against the base URL of the page.
+func resolveFormAction(pageURL, baseURL *url.URL, action string) (*url.URL, error) {
+	action = strings.TrimSpace(action)
+	if action == "" {
+		resolved := *pageURL
+		resolved.Fragment = ""
+		return &resolved, nil
+	}
+	resolved, err := resolveURL(baseURL, action)
+	if err != nil {
+		return nil, err
+	}
+	resolved.Fragment = ""
+	return resolved, nil
+}
+
+// resolveURL resolves a (possibly relative) URL found in a page against the base URL of that page.
+func resolveURL(baseURL *url.URL, ref string) (*url.URL, error) {
+	refURL, err := url.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return nil, err
+	}
+	return baseURL.ResolveReference(refURL), nil
+}
+
+func isSubmitButton(f Field) bool {
+	return f.Type == "submit" || f.Type == "image"
+}
+
+func findForms(root *html.Node) []*html.Node {
+	return findElements(root, "form")
+}
+
+func findForm(root *html.Node, selector FormSelector) *html.Node {
+	forms := findForms(root)
+
+	if selector.Selector == "" && len(selector.Fields) == 0 {
+		for _, form := range forms {
+			for _, f := range findInputs(form) {
+				if f.Type == "password" {
+					return form
+				}
+			}
+		}
+		if len(forms) > 0 {
+			return forms[0]
+		}
+		return nil
+	}
+
+	for _, form := range forms {
+		if selector.Selector != "" && !matchesSelector(form, selector.Selector) {
+			continue
+		}
+		if hasFields(findInputs(form), selector.Fields) {
+			return form
+		}
+	}
+	return nil
+}
+
+func hasFields(fields []Field, names []string) bool {
+	for _, name := range names {
+		found := false
+		for _, f := range fields {
+			if f.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesSelector reports whether a form node matches a simple CSS selector.
+func matchesSelector(n *html.Node, selector string) bool {
+	selector = strings.TrimPrefix(strings.TrimSpace(selector), "form")
+	switch {
+	case strings.HasPrefix(selector, "#"):
+		return attribute(n, "id") == selector[1:]
+	case strings.HasPrefix(selector, "."):
+		for _, class := range strings.Fields(attribute(n, "class")) {
+			if class == selector[1:] {
+				return true
+			}
+		}
+		return false
+	case strings.HasPrefix(selector, "[") && strings.HasSuffix(selector, "]"):
+		parts := strings.SplitN(selector[1:len(selector)-1], "=", 2)
+		if len(parts) == 1 {
+			_, exists := attributeValue(n, parts[0])
+			return exists
+		}
+		return attribute(n, parts[0]) == strings.Trim(parts[1], `"'`)
+	}
+	return selector == ""
+}
+
+func findInputs(formNode *html.Node) []Field {
+	var fields []Field
+
+	var inputFinder func(*html.Node)
+	inputFinder = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			_, disabled := attributeValue(n, "disabled")
+			switch n.Data {
+			case "input":
+				field := Field{Type: strings.ToLower(attribute(n, "type")), Name: attribute(n, "name"), Disabled: disabled}
+				if field.Type == "" {
+					field.Type = "text"
+				}
+				field.Value, _ = attributeValue(n, "value")
+				if _, checked := attributeValue(n, "checked"); checked {
+					field.Checked = true
+				}
+				if (field.Type == "checkbox" || field.Type == "radio") && field.Value == "" {
+					field.Value = "on"
+				}
+				fields = append(fields, field)
+			case "button":
+				// Buttons without type are submit buttons.
+				field := Field{Type: strings.ToLower(attribute(n, "type")), Name: attribute(n, "name"), Value: attribute(n, "value"), Disabled: disabled}
+				if field.Type == "" {
+					field.Type = "submit"
+				}
+				fields = append(fields, field)
+			case "textarea":
+				fields = append(fields, Field{Type: "textarea", Name: attribute(n, "name"), Value: textContent(n), Disabled: disabled})
+			case "select":
+				fields = append(fields, selectedOptions(n, disabled)...)
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			inputFinder(c)
+		}
+	}
+	inputFinder(formNode)
+	return fields
+}
+
+// selectedOptions returns a field for each selected option of a select element. When no option is selected, a
+// single select submits its first option.
+func selectedOptions(selectNode *html.Node, disabled bool) []Field {
+	name := attribute(selectNode, "name")
+	_, multiple := attributeValue(selectNode, "multiple")
+	options := findElements(selectNode, "option")
+
+	optionValue := func(option *html.Node) string {
+		if value, exists := attributeValue(option, "value"); exists {
+			return value
+		}
+		return strings.TrimSpace(textContent(option))
+	}
+
+	var fields []Field
+	for _, option := range options {
+		if _, selected := attributeValue(option, "selected"); selected {
+			fields = append(fields, Field{Type: "select", Name: name, Value: optionValue(option), Disabled: disabled})
+			if !multiple {
+				break
+			}
+		}
+	}
+	if len(fields) == 0 && !multiple && len(options) > 0 {
+		fields = append(fields, Field{Type: "select", Name: name, Value: optionValue(options[0]), Disabled: disabled})
+	}
+	return fields
+}
@@ -0,0 +1,125 @@
+package browser
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+const testForm = `<html><body>
+<form method="post" action="/login.do">
+  <input type="hidden" name="X-Uaa-Csrf" value="csrf">
+  <input name="username" value="smoke">
+  <input type="password" name="password">
+  <input type="text" name="disabled" value="ignored" disabled>
+  <input type="checkbox" name="remember">
+  <input type="checkbox" name="terms" value="accepted" checked>
+  <input type="radio" name="lang" value="en">
+  <input type="radio" name="lang" value="nl" checked>
+  <select name="zone"><option value="a">A</option><option value="b" selected>B</option></select>
+  <select name="first"><option>One</option><option>Two</option></select>
+  <select name="scopes" multiple><option selected>openid</option><option>profile</option><option selected>email</option></select>
+  <select name="none" multiple><option>x</option></select>
+  <textarea name="comment">hello</textarea>
+  <input type="reset" name="reset" value="Reset">
+  <button type="button" name="help" value="help">Help</button>
+  <button name="action" value="login">Log in</button>
+  <input type="submit" name="action" value="cancel">
+</form>
+</body></html>`
+
+func testFormValues(t *testing.T) (*Form, url.Values) {
+	pageURL, _ := url.Parse("https://login.example.com/login")
+	page := &Page{URL: pageURL, Body: []byte(testForm)}
+	form, err := page.Form(FormSelector{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return form, url.Values{
+		"X-Uaa-Csrf": {"csrf"},
+		"username":   {"smoke"},
+		"password":   {""},
+		"terms":      {"accepted"},
+		"lang":       {"nl"},
+		"zone":       {"b"},
+		"first":      {"One"},
+		"scopes":     {"openid", "email"},
+		"comment":    {"hello"},
+		"action":     {"login"},
+	}
+}
+
+func TestFormValues(t *testing.T) {
+	form, expected := testFormValues(t)
+	if form.Action != "https://login.example.com/login.do" || form.Method != "POST" {
+		t.Errorf("unexpected form %s %s", form.Method, form.Action)
+	}
+	if values := form.Values(); !reflect.DeepEqual(values, expected) {
+		t.Errorf("got %v, expected %v", values, expected)
+	}
+}
+
+func TestFormValuesFilledIn(t *testing.T) {
+	form, expected := testFormValues(t)
+	form.Set("password", "secret")
+	form.Check("remember", "", true)
+	form.Check("terms", "accepted", false)
+	form.Check("lang", "en", true)
+	form.Check("lang", "nl", false)
+	if err := form.Click("action", "cancel"); err != nil {
+		t.Fatal(err)
+	}
+	expected.Set("password", "secret")
+	expected.Set("remember", "on")
+	expected.Del("terms")
+	expected.Set("lang", "en")
+	expected.Set("action", "cancel")
+	if values := form.Values(); !reflect.DeepEqual(values, expected) {
+		t.Errorf("got %v, expected %v", values, expected)
+	}
+}
+
+func TestFormClickUnknownButton(t *testing.T) {
+	form, _ := testFormValues(t)
+	if err := form.Click("action", "delete"); err == nil {
+		t.Error("expected an error for an unknown submit button")
+	}
+	if err := form.Click("help", "help"); err == nil {
+		t.Error("expected an error for a button that does not submit")
+	}
+}
+
+func TestFormCheckRadio(t *testing.T) {
+	checks := []struct {
+		value    string
+		checked  bool
+		expected []string
+	}{
+		{"en", true, []string{"en"}},
+		{"", true, []string{"en"}},
+		{"unknown", true, []string{"nl"}},
+		{"nl", false, nil},
+		{"en", false, []string{"nl"}},
+		{"", false, nil},
+	}
+	for _, check := range checks {
+		form, _ := testFormValues(t)
+		form.Check("lang", check.value, check.checked)
+		if values := form.Values()["lang"]; !reflect.DeepEqual(values, check.expected) {
+			t.Errorf("check %q %t: got %v, expected %v", check.value, check.checked, values, check.expected)
+		}
+	}
+}
+
+func TestFormClickUnknownButtonKeepsClick(t *testing.T) {
+	form, _ := testFormValues(t)
+	if err := form.Click("action", "cancel"); err != nil {
+		t.Fatal(err)
+	}
+	if err := form.Click("action", "delete"); err == nil {
+		t.Error("expected an error for an unknown submit button")
+	}
+	if action := form.Values().Get("action"); action != "cancel" {
+		t.Errorf("submitted with %s after clicking an unknown button", action)
+	}
+}
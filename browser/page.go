@@ -0,0 +1,188 @@
+package browser
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// Page is the final response of a navigation, after following redirects.
+type Page struct {
+	// Time at which the request for this page was sent.
+	RequestedAt time.Time
+
+	URL        *url.URL
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+
+	root *html.Node
+}
+
+// ContentType returns the media type of the page, e.g. 'text/html' or 'application/json'.
+func (p *Page) ContentType() string {
+	mediaType, _, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+// Params returns the parameters in the query string and fragment of the page URL, e.g. the authorization code or
+// error of an OAuth2 redirect.
+func (p *Page) Params() url.Values {
+	return Params(p.URL)
+}
+
+// BaseURL returns the URL that relative URLs in the page resolve against: the first <base href> of the document
+// (itself resolved against the page URL), or else the page URL.
+func (p *Page) BaseURL() *url.URL {
+	root, err := p.document()
+	if err != nil {
+		return p.URL
+	}
+	for _, base := range findElements(root, "base") {
+		if href, exists := attributeValue(base, "href"); exists {
+			if baseURL, err := resolveURL(p.URL, href); err == nil {
+				return baseURL
+			}
+			break
+		}
+	}
+	return p.URL
+}
+
+// MetaRefresh returns the URL of a <meta http-equiv="refresh" content="0; url=..."> redirect in the page.
+func (p *Page) MetaRefresh() (*url.URL, bool) {
+	root, err := p.document()
+	if err != nil {
+		return nil, false
+	}
+	for _, meta := range findElements(root, "meta") {
+		if !strings.EqualFold(attribute(meta, "http-equiv"), "refresh") {
+			continue
+		}
+		for _, part := range strings.Split(attribute(meta, "content"), ";") {
+			part = strings.TrimSpace(part)
+			if len(part) > 4 && strings.EqualFold(part[:4], "url=") {
+				if refreshURL, err := resolveURL(p.BaseURL(), strings.Trim(part[4:], `"'`)); err == nil {
+					return refreshURL, true
+				}
+			}
+		}
+	}
+	return nil, false
+}
+
+// AutoPostForm returns a form that the page submits by itself, like the SAML (HTTP-POST binding) and WS-Federation
+// forms that identity providers use to post assertions back: a form with only hidden fields that carries a SAML
+// message or is submitted by JavaScript.
+func (p *Page) AutoPostForm() (*Form, bool) {
+	root, err := p.document()
+	if err != nil {
+		return nil, false
+	}
+	forms, err := p.Forms()
+	if err != nil || len(forms) == 0 {
+		return nil, false
+	}
+
+	scripted := false
+	for _, body := range findElements(root, "body") {
+		scripted = scripted || strings.Contains(attribute(body, "onload"), "submit()")
+	}
+	for _, script := range findElements(root, "script") {
+		scripted = scripted || strings.Contains(textContent(script), "submit()")
+	}
+
+	for _, form := range forms {
+		if !form.hiddenOnly() {
+			continue
+		}
+		if scripted || form.Has("SAMLResponse") || form.Has("SAMLRequest") || form.Has("wresult") {
+			return form, true
+		}
+	}
+	return nil, false
+}
+
+// Text returns the text content of the page, e.g. to look for an error message.
+func (p *Page) Text() string {
+	root, err := p.document()
+	if err != nil {
+		return string(p.Body)
+	}
+	return textContent(root)
+}
+
+// Params returns the parameters in the query string and fragment of a URL. The implicit grant and some identity
+// providers return tokens in the fragment.
+func Params(u *url.URL) url.Values {
+	params := u.Query()
+	if fragment, err := url.ParseQuery(u.Fragment); err == nil {
+		for key, values := range fragment {
+			params[key] = append(params[key], values...)
+		}
+	}
+	return params
+}
+
+func (p *Page) document() (*html.Node, error) {
+	if p.root == nil {
+		root, err := html.Parse(bytes.NewReader(p.Body))
+		if err != nil {
+			return nil, err
+		}
+		p.root = root
+	}
+	return p.root, nil
+}
+
+func findElements(root *html.Node, tag string) []*html.Node {
+	var elements []*html.Node
+	var finder func(*html.Node)
+	finder = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == tag {
+			elements = append(elements, n)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			finder(c)
+		}
+	}
+	finder(root)
+	return elements
+}
+
+func attribute(n *html.Node, key string) string {
+	value, _ := attributeValue(n, key)
+	return value
+}
+
+func attributeValue(n *html.Node, key string) (string, bool) {
+	for _, att := range n.Attr {
+		if att.Key == key {
+			return att.Val, true
+		}
+	}
+	return "", false
+}
+
+func textContent(n *html.Node) string {
+	var text strings.Builder
+	var collect func(*html.Node)
+	collect = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			text.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			collect(c)
+		}
+	}
+	collect(n)
+	return text.String()
+}
@@ -0,0 +1,232 @@
+// Package browser emulates a browser well enough to script login journeys against UAA and external identity
+// providers: it keeps cookies, follows redirects, meta refreshes and auto-post (SAML) forms, submits forms and
+// records every HTTP hop along the way.
+package browser
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"time"
+)
+
+const (
+	// Maximum number of hops (redirects, meta refreshes and auto-posts) for a single navigation.
+	maxHops = 30
+)
+
+// Timeout of a single request of a session, so a hanging server does not hang a navigation. Zero means no timeout.
+var Timeout = 30 * time.Second
+
+// Hop is a single HTTP request/response of a navigation. Durations are in nanoseconds.
+type Hop struct {
+	Method     string        `json:"method"`
+	URL        string        `json:"url"`
+	StatusCode int           `json:"statusCode,omitempty"`
+	Location   string        `json:"location,omitempty"`
+	Started    time.Time     `json:"started"`
+	Duration   time.Duration `json:"duration"`
+	Error      string        `json:"error,omitempty"`
+
+	// Phases of the request (see net/http/httptrace). DNS, connect and TLS are absent when a connection was reused.
+	DNS              time.Duration `json:"dns,omitempty"`
+	Connect          time.Duration `json:"connect,omitempty"`
+	TLS              time.Duration `json:"tls,omitempty"`
+	FirstByte        time.Duration `json:"firstByte,omitempty"`
+	ReusedConnection bool          `json:"reusedConnection,omitempty"`
+}
+
+// Session is a browser session: a cookie jar and the hops of all navigations so far.
+type Session struct {
+	// Hops of all navigations in this session, in order.
+	Hops []Hop
+
+	// Follow <meta http-equiv="refresh"> redirects and auto-post forms (on by default).
+	FollowMetaRefresh bool
+	FollowAutoPost    bool
+
+	// StopAt stops a navigation at a redirect whose target matches, without requesting it. The returned page has
+	// the URL of the redirect target, which allows codes or tokens to be taken from redirects to a redirect_uri that
+	// is not served by anything.
+	StopAt func(*url.URL) bool
+
+	// UserAgent is sent with every request when set. Some identity providers (e.g. ADFS) choose between forms and
+	// Windows integrated authentication based on it.
+	UserAgent string
+
+	client *http.Client
+}
+
+// NewSession creates a session with an empty cookie jar.
+func NewSession() *Session {
+	cookieJar, _ := cookiejar.New(nil)
+	return &Session{
+		FollowMetaRefresh: true,
+		FollowAutoPost:    true,
+		client: &http.Client{
+			Jar:     cookieJar,
+			Timeout: Timeout,
+			// Redirects are followed by the session itself, so every hop is recorded.
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+	}
+}
+
+// Get navigates to a URL.
+func (s *Session) Get(rawURL string) (*Page, error) {
+	request, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.Do(request)
+}
+
+// Submit submits a form.
+func (s *Session) Submit(form *Form) (*Page, error) {
+	request, err := form.Request()
+	if err != nil {
+		return nil, err
+	}
+	return s.Do(request)
+}
+
+// Fill sets the given fields of the form that matches the selector in the page, and submits it.
+func (s *Session) Fill(page *Page, selector FormSelector, values map[string]string) (*Page, error) {
+	form, err := page.Form(selector)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range values {
+		if !form.Has(name) {
+			return nil, fmt.Errorf("No field '%s' in form %s", name, form.Action)
+		}
+		form.Set(name, value)
+	}
+	return s.Submit(form)
+}
+
+// Do sends a request and follows redirects, and (when enabled) meta refreshes and auto-post forms, until a page is
+// reached that needs user interaction (or is final).
+func (s *Session) Do(request *http.Request) (*Page, error) {
+	for hops := 0; hops < maxHops; hops++ {
+		page, next, err := s.hop(request)
+		if err != nil || next == nil {
+			return page, err
+		}
+		request = next
+	}
+	return nil, fmt.Errorf("Stopped after %d hops", maxHops)
+}
+
+// Cookies returns the cookies the session would send to the given URL.
+func (s *Session) Cookies(u *url.URL) []*http.Cookie {
+	return s.client.Jar.Cookies(u)
+}
+
+// Param returns the last value of a parameter (e.g. 'code', 'access_token' or 'error') found in the query string or
+// fragment of any URL visited or redirected to in this session.
+func (s *Session) Param(name string) (string, bool) {
+	for i := len(s.Hops) - 1; i >= 0; i-- {
+		for _, rawURL := range []string{s.Hops[i].Location, s.Hops[i].URL} {
+			if u, err := url.Parse(rawURL); err == nil && rawURL != "" {
+				if values, found := Params(u)[name]; found && len(values) > 0 {
+					return values[len(values)-1], true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// hop performs a single request and returns the resulting page, and the next request if the page redirects.
+func (s *Session) hop(request *http.Request) (*Page, *http.Request, error) {
+	if s.UserAgent != "" {
+		request.Header.Set("User-Agent", s.UserAgent)
+	}
+
+	response, hop, err := Do(s.client, request)
+	if err != nil {
+		s.Hops = append(s.Hops, hop)
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+
+	body := new(bytes.Buffer)
+	_, err = body.ReadFrom(response.Body)
+	hop.Duration = time.Since(hop.Started)
+	s.Hops = append(s.Hops, hop)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	page := &Page{RequestedAt: hop.Started, URL: response.Request.URL, StatusCode: response.StatusCode, Header: response.Header, Body: body.Bytes()}
+
+	// Follow redirects the way a browser does.
+	if isRedirect(response.StatusCode) && hop.Location != "" {
+		location, err := resolveURL(request.URL, hop.Location)
+		if err != nil {
+			return page, nil, err
+		}
+		if s.StopAt != nil && s.StopAt(location) {
+			page.URL = location
+			return page, nil, nil
+		}
+		next, err := redirectRequest(request, response.StatusCode, location)
+		return page, next, err
+	}
+
+	if s.FollowMetaRefresh {
+		if refreshURL, found := page.MetaRefresh(); found {
+			next, err := http.NewRequest(http.MethodGet, refreshURL.String(), nil)
+			return page, next, err
+		}
+	}
+
+	if s.FollowAutoPost {
+		if form, found := page.AutoPostForm(); found {
+			next, err := form.Request()
+			return page, next, err
+		}
+	}
+
+	return page, nil, nil
+}
+
+func isRedirect(statusCode int) bool {
+	switch statusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// redirectRequest creates the request for a redirect: 307 and 308 repeat the request (including its body), the
+// others continue with a GET.
+func redirectRequest(request *http.Request, statusCode int, location *url.URL) (*http.Request, error) {
+	if statusCode != http.StatusTemporaryRedirect && statusCode != http.StatusPermanentRedirect {
+		return http.NewRequest(http.MethodGet, location.String(), nil)
+	}
+
+	var body io.Reader
+	if request.GetBody != nil {
+		bodyCopy, err := request.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		body = bodyCopy
+	} else if request.Body != nil && request.Body != http.NoBody {
+		return nil, errors.New("Unable to repeat request body for redirect to " + location.String())
+	}
+	next, err := http.NewRequest(request.Method, location.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType := request.Header.Get("Content-Type"); contentType != "" {
+		next.Header.Set("Content-Type", contentType)
+	}
+	return next, nil
+}
@@ -0,0 +1,54 @@
+package browser
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Do sends a request with the client and returns the response with the hop it made. The hop records the phases of
+// the request (DNS lookup, connect, TLS handshake and time to first byte); its duration runs until the response
+// headers were received.
+func Do(client *http.Client, request *http.Request) (*http.Response, Hop, error) {
+	hop := Hop{Method: request.Method, URL: request.URL.String()}
+
+	// The callbacks may be called from the goroutines of the transport (e.g. when dialing several addresses).
+	var mutex sync.Mutex
+	var dnsStart, connectStart, tlsStart time.Time
+	timed := func(f func()) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		f()
+	}
+	start := time.Now()
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { timed(func() { dnsStart = time.Now() }) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { timed(func() { hop.DNS = time.Since(dnsStart) }) },
+		ConnectStart: func(string, string) {
+			timed(func() { connectStart = time.Now() })
+		},
+		ConnectDone: func(string, string, error) {
+			timed(func() { hop.Connect = time.Since(connectStart) })
+		},
+		TLSHandshakeStart:    func() { timed(func() { tlsStart = time.Now() }) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { timed(func() { hop.TLS = time.Since(tlsStart) }) },
+		GotConn:              func(info httptrace.GotConnInfo) { timed(func() { hop.ReusedConnection = info.Reused }) },
+		GotFirstResponseByte: func() { timed(func() { hop.FirstByte = time.Since(start) }) },
+	}
+	request = request.WithContext(httptrace.WithClientTrace(request.Context(), trace))
+
+	response, err := client.Do(request)
+	mutex.Lock()
+	defer mutex.Unlock()
+	hop.Started = start
+	hop.Duration = time.Since(start)
+	if err != nil {
+		hop.Error = err.Error()
+		return nil, hop, err
+	}
+	hop.StatusCode = response.StatusCode
+	hop.Location = response.Header.Get("Location")
+	return response, hop, nil
+}
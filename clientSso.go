@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"net/url"
 	"golang.org/x/oauth2"
 	"encoding/json"
 
@@ -13,7 +14,9 @@ const (
 	htmlIndex = `<html>
 	<body>
 	<a href="/uaaLogin">Log in with UAA</a><br />
-	<a href="/adfsLogin">Log in with ADFS</a>
+	<a href="/uaa2Login">Log in with UAA (second client)</a><br />
+	<a href="/adfsLogin">Log in with ADFS</a><br />
+	<a href="/logout">Log out</a>
 	</body>
 	</html>`
 )
@@ -22,13 +25,29 @@ var (
 	oauth2UaaConfig = &oauth2.Config{
 		Scopes: []string{"smoketest.extinguish"},
 	}
+	oauth2Uaa2Config = &oauth2.Config{
+		Scopes: []string{"smoketest.extinguish"},
+	}
 	oauth2AdfsConfig = &oauth2.Config{
 		Scopes: []string{"openid"},
 	}
 	// Some random string, should be random for each request but we use it to distinguish between response from
 	// UAA and ADFS.
 	oauth2UaaStateString  = "random_uaa"
+	oauth2Uaa2StateString = "random_uaa2"
 	oauth2AdfsStateString = "random_adfs"
+
+	// Parameters of the login endpoints that are passed on to the authorization request, e.g. to test single sign-on
+	// with prompt=none.
+	authorizeParams = []string{"prompt", "max_age"}
+
+	// Auth domains of the UAA (zones) that users log in with, by provider ('uaa' or 'adfs'), and the URL of this app
+	// to return to after logging out.
+	authDomains = make(map[string]string)
+	appRootUrl  string
+
+	// Fields of the UAA token response that are returned by the callback endpoints.
+	tokenResponseKeys = []string{"access_token", "token_type", "refresh_token", "expires_in", "scope", "jti", "id_token"}
 )
 
 func main() {
@@ -38,6 +57,7 @@ func main() {
 	}
 
 	appUri := appEnv.ApplicationURIs[0]
+	appRootUrl = fmt.Sprintf("http://%s/", appUri)
 
 	// Configure SSO via UAA.
 	ssoUaaService, err := appEnv.Services.WithName("smoketests-sso-uaa")
@@ -49,10 +69,27 @@ func main() {
 	oauth2UaaConfig.ClientID = uaaCreds["client_id"].(string)
 	oauth2UaaConfig.ClientSecret = uaaCreds["client_secret"].(string)
 	uaaAuthDomain := uaaCreds["auth_domain"].(string)
+	authDomains["uaa"] = uaaAuthDomain
 	oauth2UaaConfig.Endpoint.AuthURL = fmt.Sprintf("%s/%s", uaaAuthDomain, "oauth/authorize")
 	oauth2UaaConfig.Endpoint.TokenURL = fmt.Sprintf("%s/%s", uaaAuthDomain, "oauth/token")
 	oauth2UaaConfig.RedirectURL = fmt.Sprintf("http://%s/uaaCallback", appUri)
 
+	// Configure a second client of the same UAA (zone), to test single sign-on across clients. This service is
+	// optional.
+	if ssoUaa2Service, err := appEnv.Services.WithName("smoketests-sso-uaa2"); err == nil {
+		uaa2Creds := ssoUaa2Service.Credentials
+		oauth2Uaa2Config.ClientID = uaa2Creds["client_id"].(string)
+		oauth2Uaa2Config.ClientSecret = uaa2Creds["client_secret"].(string)
+		uaa2AuthDomain := uaa2Creds["auth_domain"].(string)
+		authDomains["uaa2"] = uaa2AuthDomain
+		oauth2Uaa2Config.Endpoint.AuthURL = fmt.Sprintf("%s/%s", uaa2AuthDomain, "oauth/authorize")
+		oauth2Uaa2Config.Endpoint.TokenURL = fmt.Sprintf("%s/%s", uaa2AuthDomain, "oauth/token")
+		oauth2Uaa2Config.RedirectURL = fmt.Sprintf("http://%s/uaa2Callback", appUri)
+
+		http.HandleFunc("/uaa2Login", handleLogin(oauth2Uaa2Config, oauth2Uaa2StateString))
+		http.HandleFunc("/uaa2Callback", handleCallback("uaa2", oauth2Uaa2Config, oauth2Uaa2StateString))
+	}
+
 	// Configure SSO via ADFS.
 	ssoAdfsService, err := appEnv.Services.WithName("smoketests-sso-adfs")
 	if err != nil {
@@ -63,15 +100,17 @@ func main() {
 	oauth2AdfsConfig.ClientID = adfsCreds["client_id"].(string)
 	oauth2AdfsConfig.ClientSecret = adfsCreds["client_secret"].(string)
 	adfsAuthDomain := adfsCreds["auth_domain"].(string)
+	authDomains["adfs"] = adfsAuthDomain
 	oauth2AdfsConfig.Endpoint.AuthURL = fmt.Sprintf("%s/%s", adfsAuthDomain, "oauth/authorize")
 	oauth2AdfsConfig.Endpoint.TokenURL = fmt.Sprintf("%s/%s", adfsAuthDomain, "oauth/token")
 	oauth2AdfsConfig.RedirectURL = fmt.Sprintf("http://%s/adfsCallback", appUri)
 
 	http.HandleFunc("/", handleMain)
-	http.HandleFunc("/uaaLogin", handleUaaLogin)
-	http.HandleFunc("/uaaCallback", handleCallback(oauth2UaaConfig, oauth2UaaStateString))
-	http.HandleFunc("/adfsLogin", handleAdfsLogin)
-	http.HandleFunc("/adfsCallback", handleCallback(oauth2AdfsConfig, oauth2AdfsStateString))
+	http.HandleFunc("/uaaLogin", handleLogin(oauth2UaaConfig, oauth2UaaStateString))
+	http.HandleFunc("/uaaCallback", handleCallback("uaa", oauth2UaaConfig, oauth2UaaStateString))
+	http.HandleFunc("/adfsLogin", handleLogin(oauth2AdfsConfig, oauth2AdfsStateString))
+	http.HandleFunc("/adfsCallback", handleCallback("adfs", oauth2AdfsConfig, oauth2AdfsStateString))
+	http.HandleFunc("/logout", handleLogout)
 	http.ListenAndServe(fmt.Sprintf(":%v", appEnv.Port), nil)
 }
 
@@ -79,35 +118,70 @@ func handleMain(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, htmlIndex)
 }
 
-func handleUaaLogin(w http.ResponseWriter, r *http.Request) {
-	url := oauth2UaaConfig.AuthCodeURL(oauth2UaaStateString)
-	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+// handleLogin redirects to the authorization endpoint of UAA, passing on the prompt and max_age parameters.
+func handleLogin(oauth2Config *oauth2.Config, stateString string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var options []oauth2.AuthCodeOption
+		for _, param := range authorizeParams {
+			if value := r.URL.Query().Get(param); value != "" {
+				options = append(options, oauth2.SetAuthURLParam(param, value))
+			}
+		}
+		url := oauth2Config.AuthCodeURL(stateString, options...)
+		http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+	}
 }
 
-func handleAdfsLogin(w http.ResponseWriter, r *http.Request) {
-	url := oauth2AdfsConfig.AuthCodeURL(oauth2AdfsStateString)
-	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+// handleLogout clears the session of the app and logs out of UAA (which, for users that logged in via ADFS, performs a
+// SAML single logout). UAA returns to the app afterwards. Without a session, the provider to log out of can be passed
+// with the provider parameter ('uaa', 'uaa2' or 'adfs').
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	provider := r.URL.Query().Get("provider")
+	if session, found := sessions.get(r); found {
+		provider = session.provider
+	}
+	sessions.remove(w, r)
+
+	oauth2Config := oauth2UaaConfig
+	switch provider {
+	case "uaa2":
+		oauth2Config = oauth2Uaa2Config
+	case "adfs":
+		oauth2Config = oauth2AdfsConfig
+	default:
+		provider = "uaa"
+	}
+	// A provider that is not configured (uaa2 without a second binding) logs out of the first UAA.
+	if authDomains[provider] == "" {
+		provider, oauth2Config = "uaa", oauth2UaaConfig
+	}
+
+	// https://docs.cloudfoundry.org/api/uaa/version/4.7.0/index.html#logout-do
+	logoutParams := url.Values{}
+	logoutParams.Set("redirect", appRootUrl)
+	logoutParams.Set("client_id", oauth2Config.ClientID)
+	http.Redirect(w, r, fmt.Sprintf("%s/logout.do?%s", authDomains[provider], logoutParams.Encode()), http.StatusFound)
 }
 
-func handleCallback(oauth2Config *oauth2.Config, stateString string) func(http.ResponseWriter, *http.Request) {
+func handleCallback(provider string, oauth2Config *oauth2.Config, stateString string) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		queryParams := r.URL.Query()
 
 		// Check that state parameter is available.
 		state, found := queryParams["state"]
 		if !found {
-			w.WriteHeader(http.StatusBadRequest)
 			w.Header().Set("Content-Type", "application/json")
-			js, _ := json.Marshal(authenticationError{"No oauth2 state", fmt.Sprintf("Expected oauth2 state '%s' but no state was found", stateString)})
+			w.WriteHeader(http.StatusBadRequest)
+			js, _ := json.Marshal(authenticationError{"missing_state", fmt.Sprintf("Expected oauth2 state '%s' but no state was found", stateString)})
 			w.Write(js)
 			return
 		}
 
 		// Check state against known state.
 		if state[0] != stateString {
-			w.WriteHeader(http.StatusBadRequest)
 			w.Header().Set("Content-Type", "application/json")
-			js, _ := json.Marshal(authenticationError{"Invalid oauth2 state", fmt.Sprintf("Invalid oauth2 state: expected '%s', got '%s'", stateString, state[0])})
+			w.WriteHeader(http.StatusBadRequest)
+			js, _ := json.Marshal(authenticationError{"invalid_state", fmt.Sprintf("Invalid oauth2 state: expected '%s', got '%s'", stateString, state[0])})
 			w.Write(js)
 			return
 		}
@@ -115,8 +189,8 @@ func handleCallback(oauth2Config *oauth2.Config, stateString string) func(http.R
 		// Get authorization code.
 		code, found := queryParams["code"]
 		if !found {
-			w.WriteHeader(http.StatusBadRequest)
 			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
 			var authError authenticationError
 
 			// Check if we have error and error_description params in query.
@@ -128,7 +202,7 @@ func handleCallback(oauth2Config *oauth2.Config, stateString string) func(http.R
 					authError.ErrorDescription = errorDescription[0]
 				}
 			} else {
-				authError = authenticationError{"No code parameter", "Expected code parameter in request for token exchange"}
+				authError = authenticationError{"missing_code", "Expected code parameter in request for token exchange"}
 			}
 
 			js, _ := json.Marshal(authError)
@@ -139,21 +213,29 @@ func handleCallback(oauth2Config *oauth2.Config, stateString string) func(http.R
 		// Exchange authorization code for token.
 		token, err := oauth2Config.Exchange(oauth2.NoContext, code[0])
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
 			w.Header().Set("Content-Type", "application/json")
-			js, _ := json.Marshal(authenticationError{Error: err.Error()})
+			w.WriteHeader(http.StatusBadRequest)
+			js, _ := json.Marshal(authenticationError{"token_exchange_failed", err.Error()})
 			w.Write(js)
 			return
 		}
 
-		// We received a token, whoopdeedoo.
+		// We received a token, whoopdeedoo. Return the token response as received from UAA (oauth2.Token does not
+		// have expires_in, scope, jti and id_token).
+		tokenResponse := make(map[string]interface{})
+		for _, key := range tokenResponseKeys {
+			if value := token.Extra(key); value != nil && value != "" {
+				tokenResponse[key] = value
+			}
+		}
+		sessions.create(w, provider)
 		w.Header().Set("Content-Type", "application/json")
-		js, _ := json.Marshal(token)
+		js, _ := json.Marshal(tokenResponse)
 		w.Write(js)
 	}
 }
 
 type authenticationError struct {
-	Error            string `json:error,omitempty`
-	ErrorDescription string `json:error_description,omitempty`
+	Error            string `json:"error,omitempty"`
+	ErrorDescription string `json:"error_description,omitempty"`
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Name of the cookie that holds the session id of the app.
+	sessionCookieName = "smoketests_session"
+
+	// Sessions expire after the TTL; when the store is full, the oldest session is evicted. The smoke tests log out
+	// at the end of every run, but a run that fails halfway leaves its session behind.
+	sessionTTL  = time.Hour
+	maxSessions = 1000
+)
+
+// appSession is the session of a user that logged in to the app: the provider it logged in with, which /logout logs
+// out of.
+type appSession struct {
+	provider string
+	created  time.Time
+}
+
+// sessionStore keeps the sessions of the app in memory.
+type sessionStore struct {
+	mutex    sync.Mutex
+	sessions map[string]*appSession
+}
+
+var sessions = &sessionStore{sessions: make(map[string]*appSession)}
+
+// create stores a new session for a provider and sets its cookie.
+func (s *sessionStore) create(w http.ResponseWriter, provider string) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		panic(err)
+	}
+	id := hex.EncodeToString(idBytes)
+	now := time.Now()
+
+	s.mutex.Lock()
+	oldestID := ""
+	for sessionID, session := range s.sessions {
+		if now.Sub(session.created) > sessionTTL {
+			delete(s.sessions, sessionID)
+		} else if oldestID == "" || session.created.Before(s.sessions[oldestID].created) {
+			oldestID = sessionID
+		}
+	}
+	if len(s.sessions) >= maxSessions {
+		delete(s.sessions, oldestID)
+	}
+	s.sessions[id] = &appSession{provider: provider, created: now}
+	s.mutex.Unlock()
+
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: id, Path: "/", MaxAge: int(sessionTTL / time.Second), HttpOnly: true})
+}
+
+// get returns the session of the request, if any and not expired.
+func (s *sessionStore) get(r *http.Request) (*appSession, bool) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil, false
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	session, found := s.sessions[cookie.Value]
+	if found && time.Since(session.created) > sessionTTL {
+		delete(s.sessions, cookie.Value)
+		return nil, false
+	}
+	return session, found
+}
+
+// remove deletes the session of the request and expires its cookie.
+func (s *sessionStore) remove(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		s.mutex.Lock()
+		delete(s.sessions, cookie.Value)
+		s.mutex.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+}
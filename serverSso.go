@@ -2,14 +2,27 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"time"
 
 	"github.com/cloudfoundry-community/go-cfenv"
+
+	"github.com/orangeglasses/cf-uaa-tests/browser"
 )
 
 const (
-	uaaSmokeUsername = "smokeuser"
-	uaaSmokePassword = "smokepassword"
-	smokeScope       = "smoketest.extinguish"
+	smokeScope = "smoketest.extinguish"
+
+	// Prefix of the temporary UAA user; every run creates a user with a random suffix, so concurrent runs (e.g. of
+	// several instances) do not interfere.
+	smokeUsernamePrefix = "smokeuser-"
+
+	// Prefix of the temporary OAuth client that is registered to test the client registration API.
+	smokeClientIDPrefix = "smoketest-client-"
+
+	// Lifetime (in seconds) of the access tokens of the temporary OAuth client.
+	smokeClientTokenValidity = 600
 )
 
 type SmokeTest interface {
@@ -17,75 +30,286 @@ type SmokeTest interface {
 }
 
 type ssoTest struct {
+	serviceName  string
 	authDomain   string
 	clientId     string
 	clientSecret string
+	zone         IdentityZone
+
+	// Client app (clientSso.go) whose clients live in the zone, for the browser steps. These do not run without one.
+	clientApp clientApp
+
+	// Window within which expiring identity provider certificates are reported, and whether these fail the run.
+	certificateExpiryWarning time.Duration
+	certificateExpiryFail    bool
+
+	// Whether MFA (Google Authenticator) is enabled for the zone, in which case the smoke user registers for MFA.
+	mfa bool
+
+	// Whether single sign-on to a second client of the client app (/uaa2Login) is checked.
+	singleSignOn bool
+
+	// Answer to the UAA scope approval page and whether denying the approval is tested as well.
+	consent            consentDecision
+	checkConsentDenial bool
+
+	// Scripted login journeys (see LoadJourneys).
+	journeys      []Journey
+	journeysError error
+
+	// Steps to run when a run has no filter of its own (see stepFilter).
+	filter stepFilter
+
+	// Progress of a run is logged here; logOutput when nil.
+	log io.Writer
 }
 
-func main() {}
+// main runs the command-line runner when started with the run command (see runCommand), and does nothing otherwise:
+// the service that embeds this package starts the suite through ssoTestNew.
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "run" {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+}
 
+// ssoTestNew creates a test target for every bound p-identity service instance. Each instance maps to a UAA
+// identity zone (the service plan) and the full suite is run against each of them.
 func ssoTestNew(env *cfenv.App) SmokeTest {
 	identityServices, err := env.Services.WithLabel("p-identity")
 	if err != nil {
-		return &ssoTest{"", "", ""}
+		return ssoTests{}
+	}
+
+	switchZoneHeaders := envBool("SMOKE_ZONE_SWITCH_HEADERS")
+	certificateExpiryWarning := time.Duration(envInt("SMOKE_CERT_EXPIRY_WARNING_DAYS", 30)) * 24 * time.Hour
+	certificateExpiryFail := envBool("SMOKE_CERT_EXPIRY_FAIL")
+	var journeys []Journey
+	var journeysError error
+	if journeysDir := os.Getenv("SMOKE_JOURNEYS_DIR"); journeysDir != "" {
+		journeys, journeysError = LoadJourneys(journeysDir)
+	}
+
+	filter, err := stepFilterFromEnv()
+	if err != nil {
+		logf("Not running the smoke tests, invalid step filter: %s", err.Error())
+		return invalidSmokeTest{err: fmt.Errorf("invalid step filter: %s", err.Error())}
 	}
 
-	creds := identityServices[0].Credentials
-	return &ssoTest{
-		creds["auth_domain"].(string),
-		creds["client_id"].(string),
-		creds["client_secret"].(string),
+	var serviceNames []string
+	for _, service := range identityServices {
+		serviceNames = append(serviceNames, service.Name)
+	}
+	clientApps := clientAppsFromEnv(serviceNames)
+
+	var tests ssoTests
+	for _, service := range identityServices {
+		creds := service.Credentials
+		authDomain := credentialString(creds, "auth_domain")
+		tests = append(tests, &ssoTest{
+			serviceName:  service.Name,
+			authDomain:   authDomain,
+			clientId:     credentialString(creds, "client_id"),
+			clientSecret: credentialString(creds, "client_secret"),
+			zone: IdentityZone{
+				ID:            credentialString(creds, "identity_zone_id"),
+				Subdomain:     zoneSubdomain(authDomain),
+				SwitchHeaders: switchZoneHeaders,
+			},
+			clientApp:                clientApps[service.Name],
+			certificateExpiryWarning: certificateExpiryWarning,
+			certificateExpiryFail:    certificateExpiryFail,
+			mfa:                      envBool("SMOKE_MFA"),
+			singleSignOn:             envBool("SMOKE_SSO_SECOND_CLIENT"),
+			consent:                  consentDecisionFromEnv(),
+			checkConsentDenial:       envBool("SMOKE_CONSENT_CHECK_DENIAL"),
+			journeys:                 journeys,
+			journeysError:            journeysError,
+			filter:                   filter,
+		})
+	}
+
+	// Run the suite continuously when an interval is configured, besides the runs that are triggered (by the service
+	// or through /run).
+	runTrigger.setTests(tests)
+	startScheduler(tests)
+	return tests
+}
+
+// invalidSmokeTest is the smoke test of a configuration that the suite cannot run with: every run logs why and fails.
+type invalidSmokeTest struct {
+	err error
+}
+
+func (t invalidSmokeTest) run() interface{} {
+	logf("Not running the smoke tests, %s", t.err.Error())
+	return false
+}
+
+// logOutput receives what the suite logs: the progress of runs (unless a test target has a log of its own), the
+// scheduler and failed webhook deliveries. The command-line runner sets it to standard error, as standard output
+// carries the report.
+var logOutput io.Writer = os.Stdout
+
+// logf logs a line to logOutput.
+func logf(format string, args ...interface{}) {
+	fmt.Fprintf(logOutput, format+"\n", args...)
+}
+
+// logf logs the progress of a run.
+func (t *ssoTest) logf(format string, args ...interface{}) {
+	fmt.Fprintf(t.logWriter(), format+"\n", args...)
+}
+
+func (t *ssoTest) logWriter() io.Writer {
+	if t.log == nil {
+		return logOutput
 	}
+	return t.log
 }
 
 func (t *ssoTest) run() interface{} {
-	fmt.Println("Found client id: " + t.clientId)
+	if result := t.runFlows(t.selection(t.filter)); result != nil {
+		return result
+	}
+	return false
+}
+
+// runFlows runs the selected steps of the suite against the identity zone of this test target. It returns nil when
+// the target has no client to run the suite with. A step that panics is reported as errored and ends the run.
+func (t *ssoTest) runFlows(selection stepSelection) (oauth2FlowsTestResult *Oauth2FlowsTestResult) {
+	t.logf("Found client id: %s", t.clientId)
 	if t.clientId == "" {
-		fmt.Println("No client_id found")
-		return false
+		t.logf("No client_id found")
+		return nil
 	}
 
-	oauth2FlowsTestResult := &Oauth2FlowsTestResult{}
+	oauth2FlowsTestResult = &Oauth2FlowsTestResult{}
+	currentStep := ""
+	selected := func(step string) bool {
+		if !selection.selected(step) {
+			return false
+		}
+		currentStep = step
+		return true
+	}
+
+	// The admin requests share a token of the bound client, which is renewed when it is about to expire.
+	var clientCredentialsTokenResponse TokenResponse
+	adminTokens := NewTokenSource(t.clientId, t.clientSecret, t.authDomain)
+	adminTokens.log = t.logWriter()
+
+	// Once the run is done, remove the resources it created and report the status of every step (deferred functions
+	// run in reverse order).
+	cleanup := newCleanupRegistry()
+	defer t.completeResult(oauth2FlowsTestResult, selection)
+	defer func() {
+		t.reportCleanup(oauth2FlowsTestResult, cleanup.teardown(adminTokens))
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			t.logf("Step '%s' panicked: %v", currentStep, r)
+			oauth2FlowsTestResult.setStepResult(currentStep, panicResult(r))
+		}
+	}()
 
 	// Authenticate against UAA using client_credentials grant type and provided client id and secret.
-	clientCredentialsTokenResponse, clientCredentialsTestResult := ClientCredentialsAuthentication(t.clientId, t.clientSecret, t.authDomain)
-	oauth2FlowsTestResult.ClientCredentials = &clientCredentialsTestResult
-	if clientCredentialsTestResult.HasError() {
-		return oauth2FlowsTestResult
-	}
-
-	// Create a local user, authenticating with the token we acquired above (which should have scim.write scope).
-	// SCIM stands for System for Cross-domain Identity Management (http://www.simplecloud.info/).
-	user := ScimUser{
-		UserName:     uaaSmokeUsername,
-		Name:         ScimUserName{Formatted: "Smoke User", FamilyName: "User", GivenName: "Smoke"},
-		Emails:       []ScimAttribute{{Value: "smokeuser@smoke.nl"}},
-		Active:       true,
-		Verified:     true,
-		Origin:       "uaa",
-		Password:     uaaSmokePassword,
-		ScimResource: ScimResource{ExternalID: "", Meta: nil, Schemas: []string{"urn:scim:schemas:core:1.0"}},
-	}
-	createdUser, createUserTestResult := CreateUser(user, clientCredentialsTokenResponse.AccessToken, t.authDomain)
-	oauth2FlowsTestResult.CreateUser = &createUserTestResult
-	if createUserTestResult.HasError() {
-		return oauth2FlowsTestResult
-	}
-
-	if createdUser != nil {
-		// Delete local user after we're finished (via defer).
-		defer func(res *Oauth2FlowsTestResult) {
-			deleteUserTestResult := DeleteUser(createdUser.ID, clientCredentialsTokenResponse.AccessToken, t.authDomain)
-			res.DeleteUser = &deleteUserTestResult
-		}(oauth2FlowsTestResult)
-
-		// Get all groups (to be able to assign new user to groups).
-		groups, getGroupsResult := GetGroups(clientCredentialsTokenResponse.AccessToken, t.authDomain)
-		oauth2FlowsTestResult.GetGroups = &getGroupsResult
+	if selected("clientCredentials") {
+		var clientCredentialsTestResult TestResult
+		clientCredentialsTokenResponse, clientCredentialsTestResult = ClientCredentialsAuthentication(t.clientId, t.clientSecret, t.authDomain)
+		oauth2FlowsTestResult.ClientCredentials = finished(clientCredentialsTestResult)
+		if clientCredentialsTestResult.HasError() {
+			return oauth2FlowsTestResult
+		}
+		adminTokens.set(clientCredentialsTokenResponse)
+	}
+
+	// Check that the bound client has the authorities needed by the selected admin checks before running them. The
+	// steps that need a missing authority do not run, with the authority as the reason, instead of failing with a 403
+	// halfway through the run; the other steps run.
+	if selected("preflight") {
+		authorityReport, preflightResult := CheckAuthorities(adminTokens.AccessToken(), selection.checks())
+		oauth2FlowsTestResult.Authorities = &authorityReport
+		oauth2FlowsTestResult.Preflight = finished(preflightResult)
+		if preflightResult.HasError() {
+			return oauth2FlowsTestResult
+		}
+		if len(authorityReport.Missing) > 0 {
+			t.logf("Client '%s' is missing authorities %s", authorityReport.ClientID, authorityReport.missingDescription())
+		}
+		selection.deselect(authorityReport.blockedSteps(), t.disabledSteps())
+	}
+
+	// List the identity providers of the zone and check the expiry of SAML metadata and signing certificates. An
+	// expiring certificate is a warning, unless configured to fail the step, and does not prevent the other tests
+	// from running.
+	if selected("identityProviderInventory") {
+		identityProviders, identityProvidersResult := IdentityProviderInventory(adminTokens, t.authDomain, t.zone, t.certificateExpiryWarning, t.certificateExpiryFail)
+		oauth2FlowsTestResult.IdentityProviders = identityProviders
+		oauth2FlowsTestResult.IdentityProviderInventory = finished(identityProvidersResult)
+	}
+
+	var createdUser *ScimUser
+	uaaSmokeUsername := smokeUsernamePrefix + string(randomCharacters(lowerCaseCharacters+digitCharacters, 8))
+	var uaaSmokePassword string
+	if selected("createUser") {
+		// Remove the users of earlier runs that could not clean up.
+		t.removeLeftoverUsers(adminTokens)
+
+		// Generate a random password for the local user that satisfies the password policy of the zone. The password is
+		// only kept in memory for the duration of this run. Reading the policy is part of the createUser step: its
+		// requests go first in the trace, and a policy that cannot be used is a warning.
+		policyResult := defaultTestResult()
+		passwordPolicy, err := GetPasswordPolicy(adminTokens, t.authDomain, t.zone, &policyResult)
+		if err == nil {
+			err = passwordPolicy.validate()
+		}
+		if err != nil {
+			t.logf("Unable to use password policy, using default policy: %s", err.Error())
+			policyResult.Warnings = append(policyResult.Warnings, redactText("Unable to use password policy, using default policy: "+err.Error()))
+			passwordPolicy = defaultPasswordPolicy()
+		}
+		uaaSmokePassword = GeneratePassword(passwordPolicy)
+
+		// Create a local user, authenticating with the token we acquired above (which should have scim.write scope).
+		// SCIM stands for System for Cross-domain Identity Management (http://www.simplecloud.info/).
+		user := ScimUser{
+			UserName:     uaaSmokeUsername,
+			Name:         ScimUserName{Formatted: "Smoke User", FamilyName: "User", GivenName: "Smoke"},
+			Emails:       []ScimAttribute{{Value: uaaSmokeUsername + "@smoke.nl"}},
+			Active:       true,
+			Verified:     true,
+			Origin:       "uaa",
+			Password:     uaaSmokePassword,
+			ScimResource: ScimResource{ExternalID: "", Meta: nil, Schemas: []string{"urn:scim:schemas:core:1.0"}},
+		}
+		var createUserTestResult TestResult
+		createdUser, createUserTestResult = CreateUser(user, adminTokens, t.authDomain, t.zone)
+		createUserTestResult.Started = policyResult.Started
+		createUserTestResult.Trace = append(policyResult.Trace, createUserTestResult.Trace...)
+		createUserTestResult.Warnings = append(policyResult.Warnings, createUserTestResult.Warnings...)
+		oauth2FlowsTestResult.CreateUser = finished(createUserTestResult)
+		if createUserTestResult.HasError() || createdUser == nil {
+			return oauth2FlowsTestResult
+		}
+
+		// Delete the local user at the end of the run.
+		cleanup.add(userResource, createdUser.ID, uaaSmokeUsername, func(tokens *TokenSource) TestResult {
+			return DeleteUser(createdUser.ID, tokens, t.authDomain, t.zone)
+		})
+	}
+
+	// Get all groups (to be able to assign new user to groups).
+	var groups []ScimResource
+	if selected("getGroups") {
+		var getGroupsResult TestResult
+		groups, getGroupsResult = GetGroups(adminTokens, t.authDomain, t.zone)
+		oauth2FlowsTestResult.GetGroups = finished(getGroupsResult)
 		if getGroupsResult.HasError() {
 			return oauth2FlowsTestResult
 		}
+	}
 
+	if selected("addGroupMemberResult") {
 		// Get smoketest.extinguish group.
 		var smokeExtinguishGroup ScimResource
 		for i := range groups {
@@ -96,47 +320,280 @@ func (t *ssoTest) run() interface{} {
 		}
 
 		// Assign user to smoketest.extinguish group.
-		addMemberResult := AddGroupMember(smokeExtinguishGroup.ID, createdUser.ID, clientCredentialsTokenResponse.AccessToken, t.authDomain)
-		oauth2FlowsTestResult.AddGroupMember = &addMemberResult
+		addMemberResult := AddGroupMember(smokeExtinguishGroup.ID, createdUser.ID, adminTokens, t.authDomain, t.zone)
+		oauth2FlowsTestResult.AddGroupMember = finished(addMemberResult)
 		if addMemberResult.HasError() {
 			return oauth2FlowsTestResult
 		}
+		cleanup.add(membershipResource, smokeExtinguishGroup.ID+"/"+createdUser.ID, smokeScope, func(tokens *TokenSource) TestResult {
+			return RemoveGroupMember(smokeExtinguishGroup.ID, createdUser.ID, tokens, t.authDomain, t.zone)
+		})
+	}
 
-		// Authenticate directly against UAA with newly created user using password grant type.
-		// (https://tools.ietf.org/html/rfc6749#section-4.3)
-		// This does not involve ADFS yet, goes directly to UAA.
-		_, userTokenTestResult := PasswordAuthentication(t.clientId, t.clientSecret, t.authDomain, uaaSmokeUsername, uaaSmokePassword)
-		oauth2FlowsTestResult.Password = &userTokenTestResult
+	// When MFA is enabled for the zone, register the user for MFA by logging in on UAA. The TOTP secret is only kept
+	// in memory; codes are computed from it for the password grants and logins below.
+	var mfa *mfaCredentials
+	if t.mfa && selected("registerMfa") {
+		var registerMfaResult TestResult
+		mfa, registerMfaResult = RegisterMfa(uaaSmokeUsername, uaaSmokePassword, t.authDomain)
+		oauth2FlowsTestResult.RegisterMfa = finished(registerMfaResult)
+		if registerMfaResult.HasError() {
+			return oauth2FlowsTestResult
+		}
+	}
+
+	// Authenticate directly against UAA with newly created user using password grant type.
+	// (https://tools.ietf.org/html/rfc6749#section-4.3)
+	// This does not involve ADFS yet, goes directly to UAA.
+	if selected("password") {
+		_, userTokenTestResult := PasswordAuthentication(t.clientId, t.clientSecret, t.authDomain, uaaSmokeUsername, uaaSmokePassword, mfaCode(mfa))
+		oauth2FlowsTestResult.Password = finished(userTokenTestResult)
 		if userTokenTestResult.HasError() {
 			return oauth2FlowsTestResult
 		}
+	}
+
+	// Register a temporary OAuth client, exercise the client registration API and authenticate with the client
+	// (this requires the clients.read, clients.write and clients.secret authorities).
+	smokeClient := OAuthClient{
+		ClientID:             smokeClientIDPrefix + string(randomCharacters(lowerCaseCharacters+digitCharacters, 8)),
+		ClientSecret:         GeneratePassword(defaultPasswordPolicy()),
+		Name:                 "Smoke Client",
+		Scope:                []string{"openid", smokeScope},
+		ResourceIDs:          []string{"none"},
+		AuthorizedGrantTypes: []string{clientCredentialsGrantType, passwordGrantType},
+		Authorities:          []string{"uaa.resource"},
+		Autoapprove:          []string{"true"},
+		AccessTokenValidity:  smokeClientTokenValidity,
+	}
+	var createdClient *OAuthClient
+	if selected("createClient") {
+		// Remove the clients of earlier runs that could not clean up.
+		t.removeLeftoverClients(adminTokens)
+
+		var createClientResult TestResult
+		createdClient, createClientResult = CreateClient(smokeClient, adminTokens, t.authDomain, t.zone)
+		oauth2FlowsTestResult.CreateClient = finished(createClientResult)
+		if createClientResult.HasError() {
+			return oauth2FlowsTestResult
+		}
+
+		// Delete the temporary client at the end of the run.
+		cleanup.add(clientResource, smokeClient.ClientID, smokeClient.Name, func(tokens *TokenSource) TestResult {
+			return DeleteClient(smokeClient.ClientID, tokens, t.authDomain, t.zone)
+		})
+	}
+
+	// Fetch the client and check that it is the one we registered.
+	var fetchedClient *OAuthClient
+	if selected("getClient") {
+		var getClientResult TestResult
+		fetchedClient, getClientResult = GetClient(createdClient.ClientID, adminTokens, t.authDomain, t.zone)
+		if !getClientResult.HasError() && (fetchedClient == nil || fetchedClient.ClientID != smokeClient.ClientID) {
+			getClientResult.Result = false
+			getClientResult.Error = "client_mismatch"
+			getClientResult.ErrorDescription = fmt.Sprintf("Expected client '%s' to be returned", smokeClient.ClientID)
+		}
+		oauth2FlowsTestResult.GetClient = finished(getClientResult)
+		if getClientResult.HasError() {
+			return oauth2FlowsTestResult
+		}
+	}
+
+	// Update the client: allow it to request the smoke scope without the openid scope.
+	if selected("updateClient") {
+		fetchedClient.Name = "Smoke Client (updated)"
+		fetchedClient.Scope = []string{smokeScope}
+		_, updateClientResult := UpdateClient(*fetchedClient, adminTokens, t.authDomain, t.zone)
+		oauth2FlowsTestResult.UpdateClient = finished(updateClientResult)
+		if updateClientResult.HasError() {
+			return oauth2FlowsTestResult
+		}
+	}
+
+	// Rotate the client secret.
+	newClientSecret := GeneratePassword(defaultPasswordPolicy())
+	if selected("changeClientSecret") {
+		changeSecretResult := ChangeClientSecret(smokeClient.ClientID, smokeClient.ClientSecret, newClientSecret, adminTokens, t.authDomain, t.zone)
+		oauth2FlowsTestResult.ChangeClientSecret = finished(changeSecretResult)
+		if changeSecretResult.HasError() {
+			return oauth2FlowsTestResult
+		}
+	}
+
+	// Authenticate with the temporary client and its new secret using the client credentials and password grant types.
+	tokens := map[string]TokenResponse{}
+	if selection.selected("clientCredentials") {
+		tokens["clientCredentials"] = clientCredentialsTokenResponse
+	}
+	if selected("smokeClientCredentials") {
+		smokeClientTokenResponse, smokeClientCredentialsResult := ClientCredentialsAuthentication(smokeClient.ClientID, newClientSecret, t.authDomain)
+		oauth2FlowsTestResult.SmokeClientCredentials = finished(smokeClientCredentialsResult)
+		if smokeClientCredentialsResult.HasError() {
+			return oauth2FlowsTestResult
+		}
+		tokens["smokeClientCredentials"] = smokeClientTokenResponse
+	}
+	if selected("smokeClientPassword") {
+		_, smokeClientPasswordResult := PasswordAuthentication(smokeClient.ClientID, newClientSecret, t.authDomain, uaaSmokeUsername, uaaSmokePassword, mfaCode(mfa))
+		oauth2FlowsTestResult.SmokeClientPassword = finished(smokeClientPasswordResult)
+		if smokeClientPasswordResult.HasError() {
+			return oauth2FlowsTestResult
+		}
+	}
+
+	// Authenticate against UAA using the authorization code grant type (https://tools.ietf.org/html/rfc6749#section-4.1).
+	// Does still not involve ADFS yet. This requires an application that is protected by a UAA client.
+	// When the client is not autoapprove, first check that denying the scope approval is reported to the client app
+	// as access_denied. This is done before approving, as UAA remembers approved scopes.
+	if t.checkConsentDenial && selected("authCodeUAADenied") {
+		_, consentDeniedResult := UaaAuthorizationCodeAuthentication(t.clientApp, browser.NewSession(), uaaSmokeUsername, uaaSmokePassword, mfa, consentDecision{approve: false})
+		if consentDeniedResult.Error == "access_denied" {
+			consentDeniedResult = consentDeniedResult.passed()
+		} else if !consentDeniedResult.HasError() {
+			consentDeniedResult.Result = false
+			consentDeniedResult.Error = "consent_not_denied"
+			consentDeniedResult.ErrorDescription = "Expected access_denied after denying the scope approval, but received a token (is the client autoapprove?)"
+		}
+		oauth2FlowsTestResult.AuthorizationCodeUAADenied = finished(consentDeniedResult)
+		if consentDeniedResult.HasError() {
+			return oauth2FlowsTestResult
+		}
+	}
 
-		// Authenticate against UAA using the authorization code grant type (https://tools.ietf.org/html/rfc6749#section-4.1).
-		// Does still not involve ADFS yet. This requires an application that is protected by a UAA client.
-		_, uaaAuthorizationCodeResult := UaaAuthorizationCodeAuthentication(uaaSmokeUsername, uaaSmokePassword)
-		oauth2FlowsTestResult.AuthorizationCodeUAA = &uaaAuthorizationCodeResult
+	// With MFA, first check that a wrong code is rejected.
+	if mfa != nil && selected("authCodeUAAInvalidMfa") {
+		invalidMfa := *mfa
+		invalidMfa.invalid = true
+		_, invalidMfaResult := UaaAuthorizationCodeAuthentication(t.clientApp, browser.NewSession(), uaaSmokeUsername, uaaSmokePassword, &invalidMfa, t.consent)
+		if invalidMfaResult.Error == "mfa_code_rejected" {
+			invalidMfaResult = invalidMfaResult.passed()
+		} else if !invalidMfaResult.HasError() {
+			invalidMfaResult.Result = false
+			invalidMfaResult.Error = "mfa_code_not_rejected"
+			invalidMfaResult.ErrorDescription = "Expected UAA to reject a wrong MFA code, but received a token"
+		}
+		oauth2FlowsTestResult.AuthorizationCodeUAAInvalidMfa = finished(invalidMfaResult)
+		if invalidMfaResult.HasError() {
+			return oauth2FlowsTestResult
+		}
+	}
+
+	uaaSession := browser.NewSession()
+	if selected("authCodeUAA") {
+		uaaAuthorizationCodeTokenResponse, uaaAuthorizationCodeResult := UaaAuthorizationCodeAuthentication(t.clientApp, uaaSession, uaaSmokeUsername, uaaSmokePassword, mfa, t.consent)
+		oauth2FlowsTestResult.AuthorizationCodeUAA = finished(uaaAuthorizationCodeResult)
 		if uaaAuthorizationCodeResult.HasError() {
 			return oauth2FlowsTestResult
 		}
+		tokens["authCodeUAA"] = uaaAuthorizationCodeTokenResponse
+	}
+
+	// Check that the lifetimes of the tokens we received match the access_token_validity of their clients.
+	if selected("tokenLifetimes") {
+		tokenLifetimesResult := CheckTokenLifetimes(tokens, adminTokens, t.authDomain, t.zone)
+		oauth2FlowsTestResult.TokenLifetimes = finished(tokenLifetimesResult)
+		if tokenLifetimesResult.HasError() {
+			return oauth2FlowsTestResult
+		}
+	}
+
+	// Check that the UAA session is reused for a second client, without logging in again.
+	if t.singleSignOn && selected("singleSignOn") {
+		singleSignOnResult := SingleSignOn(t.clientApp, uaaSession, t.consent)
+		oauth2FlowsTestResult.SingleSignOn = finished(singleSignOnResult)
+		if singleSignOnResult.HasError() {
+			return oauth2FlowsTestResult
+		}
+	}
 
-		// Authenticate against ADFS using the authorization code grant type (https://tools.ietf.org/html/rfc6749#section-4.1).
-		_, adfsAuthorizationCodeResult := AdfsAuthorizationCodeAuthentication("ad\\aduser", "password")
-		oauth2FlowsTestResult.AuthorizationCodeAdfs = &adfsAuthorizationCodeResult
+	// Log out of UAA and check that the UAA session has ended.
+	if selected("logoutUAA") {
+		uaaLogoutResult := UaaLogout(t.clientApp, uaaSession)
+		oauth2FlowsTestResult.LogoutUAA = finished(uaaLogoutResult)
+		if uaaLogoutResult.HasError() {
+			return oauth2FlowsTestResult
+		}
+	}
+
+	// Run the scripted login journeys, if any.
+	if selected("journeys") {
+		if t.journeysError != nil || len(t.journeys) > 0 {
+			oauth2FlowsTestResult.Journeys = make(map[string]*TestResult)
+		}
+		if t.journeysError != nil {
+			journeysResult := defaultTestResult()
+			journeysResult.Result = false
+			journeysResult.Error = "invalid_journeys"
+			journeysResult.ErrorDescription = t.journeysError.Error()
+			oauth2FlowsTestResult.Journeys["load"] = finished(journeysResult)
+			return oauth2FlowsTestResult
+		}
+		journeyVars := map[string]string{"smokeUsername": uaaSmokeUsername, "smokePassword": uaaSmokePassword, "clientApp": string(t.clientApp)}
+		journeysFailed := false
+		for _, journey := range t.journeys {
+			journeyResult := RunJourney(journey, journeyVars)
+			oauth2FlowsTestResult.Journeys[journey.Name] = finished(journeyResult)
+			journeysFailed = journeysFailed || journeyResult.HasError()
+		}
+		if journeysFailed {
+			return oauth2FlowsTestResult
+		}
+	}
+
+	// Authenticate against ADFS using the authorization code grant type (https://tools.ietf.org/html/rfc6749#section-4.1).
+	adfsSession := browser.NewSession()
+	if selected("authCodeAdfs") {
+		_, adfsAuthorizationCodeResult := AdfsAuthorizationCodeAuthentication(t.clientApp, adfsSession, "ad\\aduser", "password")
+		oauth2FlowsTestResult.AuthorizationCodeAdfs = finished(adfsAuthorizationCodeResult)
 		if adfsAuthorizationCodeResult.HasError() {
 			return oauth2FlowsTestResult
 		}
 	}
 
+	// Log out of UAA, which must log out of ADFS as well (SAML single logout).
+	if selected("logoutAdfs") {
+		adfsLogoutResult := AdfsLogout(t.clientApp, adfsSession)
+		oauth2FlowsTestResult.LogoutAdfs = finished(adfsLogoutResult)
+		if adfsLogoutResult.HasError() {
+			return oauth2FlowsTestResult
+		}
+	}
+
 	return oauth2FlowsTestResult
 }
 
+// Oauth2FlowsTestResult holds the results of the steps of a run, in the order in which they run (the temporary client
+// and user are deleted at the end of the run). Reports list the steps in this order.
 type Oauth2FlowsTestResult struct {
-	ClientCredentials     *TestResult `json:"clientCredentials,omitempty"`
-	CreateUser            *TestResult `json:"createUser,omitempty"`
-	GetGroups             *TestResult `json:"getGroups,omitempty"`
-	AddGroupMember        *TestResult `json:"addGroupMemberResult,omitempty"`
-	Password              *TestResult `json:"password,omitempty"`
-	AuthorizationCodeUAA  *TestResult `json:"authCodeUAA,omitempty"`
-	AuthorizationCodeAdfs *TestResult `json:"authCodeAdfs,omitempty"`
-	DeleteUser            *TestResult `json:"deleteUser,omitempty"`
+	Verdict                        StepStatus             `json:"verdict"`
+	Summary                        StatusSummary          `json:"summary"`
+	ClientCredentials              *TestResult            `json:"clientCredentials,omitempty"`
+	Preflight                      *TestResult            `json:"preflight,omitempty"`
+	Authorities                    *AuthorityReport       `json:"authorities,omitempty"`
+	IdentityProviderInventory      *TestResult            `json:"identityProviderInventory,omitempty"`
+	IdentityProviders              []IdentityProviderInfo `json:"identityProviders,omitempty"`
+	CreateUser                     *TestResult            `json:"createUser,omitempty"`
+	GetGroups                      *TestResult            `json:"getGroups,omitempty"`
+	AddGroupMember                 *TestResult            `json:"addGroupMemberResult,omitempty"`
+	RegisterMfa                    *TestResult            `json:"registerMfa,omitempty"`
+	Password                       *TestResult            `json:"password,omitempty"`
+	CreateClient                   *TestResult            `json:"createClient,omitempty"`
+	GetClient                      *TestResult            `json:"getClient,omitempty"`
+	UpdateClient                   *TestResult            `json:"updateClient,omitempty"`
+	ChangeClientSecret             *TestResult            `json:"changeClientSecret,omitempty"`
+	SmokeClientCredentials         *TestResult            `json:"smokeClientCredentials,omitempty"`
+	SmokeClientPassword            *TestResult            `json:"smokeClientPassword,omitempty"`
+	AuthorizationCodeUAADenied     *TestResult            `json:"authCodeUAADenied,omitempty"`
+	AuthorizationCodeUAAInvalidMfa *TestResult            `json:"authCodeUAAInvalidMfa,omitempty"`
+	AuthorizationCodeUAA           *TestResult            `json:"authCodeUAA,omitempty"`
+	TokenLifetimes                 *TestResult            `json:"tokenLifetimes,omitempty"`
+	SingleSignOn                   *TestResult            `json:"singleSignOn,omitempty"`
+	LogoutUAA                      *TestResult            `json:"logoutUAA,omitempty"`
+	Journeys                       map[string]*TestResult `json:"journeys,omitempty"`
+	AuthorizationCodeAdfs          *TestResult            `json:"authCodeAdfs,omitempty"`
+	LogoutAdfs                     *TestResult            `json:"logoutAdfs,omitempty"`
+	Cleanup                        []CleanupResult        `json:"cleanup,omitempty"`
+	DeleteClient                   *TestResult            `json:"deleteClient,omitempty"`
+	DeleteUser                     *TestResult            `json:"deleteUser,omitempty"`
 }
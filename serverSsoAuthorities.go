@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Checks that use the token of the bound client, in the order in which they are run.
+var adminChecks = []string{
+	"identityProviders",
+	"passwordPolicy",
+	"createUser",
+	"getGroups",
+	"addGroupMember",
+	"createClient",
+	"getClient",
+	"updateClient",
+	"changeClientSecret",
+	"tokenLifetimes",
+	"deleteClient",
+	"deleteUser",
+}
+
+// requiredAuthorities lists the authorities the bound client needs for each check. Checks that are not listed (or
+// list no authorities) can run with any client. Optional checks fall back to a default when the authority is missing.
+var requiredAuthorities = map[string][]string{
+	"identityProviders":  {"idps.read"},
+	"createUser":         {"scim.write"},
+	"getGroups":          {"scim.read"},
+	"addGroupMember":     {"scim.write"},
+	"createClient":       {"clients.write"},
+	"getClient":          {"clients.read"},
+	"updateClient":       {"clients.write"},
+	"changeClientSecret": {"clients.secret"},
+	"tokenLifetimes":     {"clients.read"},
+	"deleteClient":       {"clients.write"},
+	"deleteUser":         {"scim.write"},
+}
+
+// Authorities that imply other authorities.
+var impliedAuthorities = map[string][]string{
+	"uaa.admin":     {"scim.read", "scim.write", "clients.read", "clients.write", "clients.secret", "idps.read"},
+	"clients.admin": {"clients.read", "clients.write", "clients.secret"},
+}
+
+// AuthorityReport lists the authorities granted to the bound client and, per missing authority, the checks it blocks.
+type AuthorityReport struct {
+	ClientID string              `json:"clientId"`
+	Granted  []string            `json:"granted"`
+	Missing  map[string][]string `json:"missing,omitempty"`
+}
+
+type accessTokenClaims struct {
+	ClientID    string   `json:"client_id"`
+	Authorities []string `json:"authorities"`
+	Scope       []string `json:"scope"`
+	IssuedAt    int64    `json:"iat"`
+	ExpiresAt   int64    `json:"exp"`
+}
+
+// CheckAuthorities decodes the client credentials token of the bound client and reports the authorities that the
+// given checks need, but the client lacks. A missing authority does not fail the check: the steps it blocks are not
+// run (see blockedSteps).
+func CheckAuthorities(accessToken string, checks []string) (AuthorityReport, TestResult) {
+	preflightResult := defaultTestResult()
+
+	claims, err := decodeAccessToken(accessToken)
+	if err != nil {
+		preflightResult.Result = false
+		preflightResult.Error = "invalid_token"
+		preflightResult.ErrorDescription = err.Error()
+		return AuthorityReport{}, preflightResult
+	}
+
+	// UAA puts the authorities of a client in both the authorities and the scope claim of a client credentials token.
+	granted := make(map[string]bool)
+	for _, authority := range append(claims.Authorities, claims.Scope...) {
+		granted[authority] = true
+		for _, implied := range impliedAuthorities[authority] {
+			granted[implied] = true
+		}
+	}
+
+	report := AuthorityReport{ClientID: claims.ClientID}
+	for _, authority := range append(claims.Authorities, claims.Scope...) {
+		if !containsString(report.Granted, authority) {
+			report.Granted = append(report.Granted, authority)
+		}
+	}
+	sort.Strings(report.Granted)
+
+	for _, check := range checks {
+		for _, authority := range requiredAuthorities[check] {
+			if granted[authority] {
+				continue
+			}
+			if report.Missing == nil {
+				report.Missing = make(map[string][]string)
+			}
+			report.Missing[authority] = append(report.Missing[authority], check)
+		}
+	}
+
+	return report, preflightResult
+}
+
+// missingDescription describes the missing authorities and the checks they block, e.g. 'idps.read' (blocks
+// identityProviders).
+func (report AuthorityReport) missingDescription() string {
+	var authorities []string
+	for authority := range report.Missing {
+		authorities = append(authorities, authority)
+	}
+	sort.Strings(authorities)
+	var descriptions []string
+	for _, authority := range authorities {
+		descriptions = append(descriptions, fmt.Sprintf("'%s' (blocks %s)", authority, strings.Join(report.Missing[authority], ", ")))
+	}
+	return strings.Join(descriptions, "; ")
+}
+
+// blockedSteps returns the steps that cannot run for lack of an authority, with the missing authority as the reason.
+func (report AuthorityReport) blockedSteps() map[string]string {
+	blocked := make(map[string]string)
+	for _, step := range steps {
+		for _, check := range step.checks {
+			for _, authority := range requiredAuthorities[check] {
+				if _, isBlocked := blocked[step.name]; !isBlocked && containsString(report.Missing[authority], check) {
+					blocked[step.name] = fmt.Sprintf("Client '%s' lacks authority '%s'", report.ClientID, authority)
+				}
+			}
+		}
+	}
+	return blocked
+}
+
+// decodeAccessToken returns the claims of a JWT access token. The signature is not verified: the token was just
+// received from UAA over TLS and is only inspected to report on it.
+func decodeAccessToken(accessToken string) (accessTokenClaims, error) {
+	var claims accessTokenClaims
+	parts := strings.Split(accessToken, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("Access token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return claims, err
+	}
+	err = json.Unmarshal(payload, &claims)
+	return claims, err
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
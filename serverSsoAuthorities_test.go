@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestMissingAuthoritiesOnlyBlockTheirSteps(t *testing.T) {
+	// A client with the authorities that the README used to list.
+	payload := `{"client_id":"smoke","authorities":["scim.write","scim.read","uaa.resource"],"scope":["scim.write","scim.read","uaa.resource"]}`
+	accessToken := "e30." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2ln"
+
+	disabled := (&ssoTest{}).disabledSteps()
+	selection := stepFilter{}.resolve(disabled)
+	report, result := CheckAuthorities(accessToken, selection.checks())
+	if result.HasError() {
+		t.Fatalf("preflight failed: %s %s", result.Error, result.ErrorDescription)
+	}
+	selection.deselect(report.blockedSteps(), disabled)
+
+	for _, step := range []string{"createUser", "getGroups", "addGroupMemberResult", "password", "authCodeUAA", "deleteUser"} {
+		if !selection.selected(step) {
+			t.Errorf("%s is not selected: %s", step, selection[step])
+		}
+	}
+	for step, reason := range map[string]string{
+		"identityProviderInventory": "Client 'smoke' lacks authority 'idps.read'",
+		"createClient":              "Client 'smoke' lacks authority 'clients.write'",
+		"tokenLifetimes":            "Client 'smoke' lacks authority 'clients.read'",
+		"smokeClientPassword":       "Needs changeClientSecret, which is not selected",
+	} {
+		if selection[step] != reason {
+			t.Errorf("unexpected reason for %s: %q", step, selection[step])
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Kinds of resources that a run creates.
+	userResource       = "user"
+	membershipResource = "membership"
+	clientResource     = "client"
+
+	// Delay before the first retry of a failed teardown; it doubles with every attempt.
+	cleanupInitialBackoff = time.Second
+)
+
+// CleanupResult reports the teardown of a resource that a run created.
+type CleanupResult struct {
+	Kind        string      `json:"kind"`
+	ID          string      `json:"id"`
+	Description string      `json:"description,omitempty"`
+	Attempts    int         `json:"attempts"`
+	Result      *TestResult `json:"result"`
+}
+
+// cleanupResource is a resource that a run created, with the function that removes it with the admin tokens of the
+// run.
+type cleanupResource struct {
+	kind        string
+	id          string
+	description string
+	teardown    func(tokens *TokenSource) TestResult
+}
+
+// cleanupRegistry records the resources that a run creates, so they are removed at the end of the run, also when a
+// step fails or panics.
+type cleanupRegistry struct {
+	mutex          sync.Mutex
+	resources      []cleanupResource
+	maxAttempts    int
+	initialBackoff time.Duration
+}
+
+func newCleanupRegistry() *cleanupRegistry {
+	return &cleanupRegistry{maxAttempts: envInt("SMOKE_CLEANUP_MAX_ATTEMPTS", 3), initialBackoff: cleanupInitialBackoff}
+}
+
+// add records a created resource.
+func (c *cleanupRegistry) add(kind, id, description string, teardown func(tokens *TokenSource) TestResult) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.resources = append(c.resources, cleanupResource{kind: kind, id: id, description: description, teardown: teardown})
+}
+
+// teardown removes the recorded resources in reverse order of creation, with tokens of the given source, which
+// renews a token of the run that expired. Failed attempts are retried with exponential back-off; a resource that no
+// longer exists (404) counts as removed.
+func (c *cleanupRegistry) teardown(tokens *TokenSource) []CleanupResult {
+	c.mutex.Lock()
+	resources := c.resources
+	c.resources = nil
+	c.mutex.Unlock()
+
+	var results []CleanupResult
+	for i := len(resources) - 1; i >= 0; i-- {
+		resource := resources[i]
+		cleanupResult := CleanupResult{Kind: resource.kind, ID: resource.id, Description: resource.description}
+		backoff := c.initialBackoff
+		for {
+			cleanupResult.Attempts++
+			result := recovered(func() TestResult { return resource.teardown(tokens) })
+			if result.HasError() && result.StatusCode != nil && *result.StatusCode == http.StatusNotFound {
+				result = result.passed()
+			}
+			cleanupResult.Result = finished(result)
+			if !result.HasError() || cleanupResult.Attempts >= c.maxAttempts {
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		results = append(results, cleanupResult)
+	}
+	return results
+}
+
+// recovered runs a test and turns a panic (a bug, as the helpers report failed requests in their result) into a failed
+// result.
+func recovered(test func() TestResult) (result TestResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			result = panicResult(r)
+		}
+	}()
+	return test()
+}
+
+// panicResult is the result of a test that panicked.
+func panicResult(value interface{}) TestResult {
+	result := defaultTestResult()
+	result.Result = false
+	result.Error = errorPanic
+	result.ErrorDescription = redactText(fmt.Sprintf("%v", value))
+	return result
+}
+
+// leftoverAge is the age after which a smoke user or client is a leftover of a run that could not clean up (e.g.
+// because it was killed), rather than in use by a concurrent run (SMOKE_LEFTOVER_AGE_SECONDS).
+func leftoverAge() time.Duration {
+	return time.Duration(envInt("SMOKE_LEFTOVER_AGE_SECONDS", 3600)) * time.Second
+}
+
+// removeLeftoverUsers deletes the local smoke users that were created longer than leftoverAge ago.
+func (t *ssoTest) removeLeftoverUsers(tokens *TokenSource) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.logf("Unable to remove leftover smoke users: %v", r)
+		}
+	}()
+	users, findResult := FindUsers(smokeUsernamePrefix, "uaa", tokens, t.authDomain, t.zone)
+	if findResult.HasError() {
+		t.logf("Unable to find leftover smoke users: %s", findResult.Error)
+		return
+	}
+	for _, user := range users {
+		if user.Meta == nil || time.Since(user.Meta.Created) < leftoverAge() {
+			continue
+		}
+		t.logf("Removing leftover smoke user '%s'", user.ID)
+		if deleteResult := DeleteUser(user.ID, tokens, t.authDomain, t.zone); deleteResult.HasError() {
+			t.logf("Unable to remove user '%s': %s", user.ID, deleteResult.Error)
+		}
+	}
+}
+
+// removeLeftoverClients deletes the temporary smoke clients that were last modified longer than leftoverAge ago.
+func (t *ssoTest) removeLeftoverClients(tokens *TokenSource) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.logf("Unable to remove leftover smoke clients: %v", r)
+		}
+	}()
+	clients, findResult := FindClients(smokeClientIDPrefix, tokens, t.authDomain, t.zone)
+	if findResult.HasError() {
+		t.logf("Unable to find leftover smoke clients: %s", findResult.Error)
+		return
+	}
+	for _, client := range clients {
+		lastModified := time.Unix(0, client.LastModified*int64(time.Millisecond))
+		if client.LastModified == 0 || time.Since(lastModified) < leftoverAge() {
+			continue
+		}
+		t.logf("Removing leftover smoke client '%s'", client.ClientID)
+		if deleteResult := DeleteClient(client.ClientID, tokens, t.authDomain, t.zone); deleteResult.HasError() {
+			t.logf("Unable to remove client '%s': %s", client.ClientID, deleteResult.Error)
+		}
+	}
+}
+
+// reportCleanup adds the cleanup results to the result of a run. The removal of the user and the client are the
+// deleteUser and deleteClient steps.
+func (t *ssoTest) reportCleanup(flowsResult *Oauth2FlowsTestResult, results []CleanupResult) {
+	flowsResult.Cleanup = results
+	for _, result := range results {
+		if result.Result.HasError() {
+			t.logf("Unable to remove %s '%s': %s", result.Kind, result.ID, result.Result.Error)
+		}
+		switch result.Kind {
+		case userResource:
+			flowsResult.DeleteUser = result.Result
+		case clientResource:
+			flowsResult.DeleteClient = result.Result
+		}
+	}
+}
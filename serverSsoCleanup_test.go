@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// teardownResults returns a teardown that records its calls and returns the given results in turn; when they run out,
+// it returns the last one.
+func teardownResults(calls *[]string, id string, results ...TestResult) func(tokens *TokenSource) TestResult {
+	return func(tokens *TokenSource) TestResult {
+		*calls = append(*calls, id)
+		result := results[0]
+		if len(results) > 1 {
+			results = results[1:]
+		}
+		return result
+	}
+}
+
+func failedWithStatus(errorCode string, status int) TestResult {
+	result := defaultTestResult()
+	result.Result = false
+	result.Error = errorCode
+	result.StatusCode = &status
+	return result
+}
+
+func TestCleanupTeardown(t *testing.T) {
+	var calls []string
+	registry := &cleanupRegistry{maxAttempts: 3, initialBackoff: time.Millisecond}
+	registry.add(userResource, "user", "smokeuser-test", teardownResults(&calls, "user", defaultTestResult()))
+	registry.add(membershipResource, "membership", "", teardownResults(&calls, "membership", failedWithStatus("scim_resource_not_found", http.StatusNotFound)))
+	registry.add(clientResource, "client", "", teardownResults(&calls, "client",
+		failedWithStatus("request_failed", http.StatusServiceUnavailable), defaultTestResult()))
+	registry.add(clientResource, "failing", "", teardownResults(&calls, "failing", failedWithStatus("access_denied", http.StatusForbidden)))
+	registry.add(userResource, "panicking", "", func(tokens *TokenSource) TestResult {
+		calls = append(calls, "panicking")
+		panic("bug")
+	})
+
+	results := registry.teardown(nil)
+
+	expectedCalls := []string{"panicking", "panicking", "panicking", "failing", "failing", "failing", "client", "client", "membership", "user"}
+	if !reflect.DeepEqual(calls, expectedCalls) {
+		t.Errorf("teardown calls %v, expected %v", calls, expectedCalls)
+	}
+
+	expected := []struct {
+		id       string
+		attempts int
+		removed  bool
+		error    string
+	}{
+		{"panicking", 3, false, errorPanic},
+		{"failing", 3, false, "access_denied"},
+		{"client", 2, true, ""},
+		{"membership", 1, true, ""},
+		{"user", 1, true, ""},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("unexpected results %+v", results)
+	}
+	for i, result := range results {
+		if result.ID != expected[i].id || result.Attempts != expected[i].attempts || result.Result.HasError() == expected[i].removed || result.Result.Error != expected[i].error {
+			t.Errorf("unexpected result of %s: %d attempts, %+v", result.ID, result.Attempts, result.Result)
+		}
+	}
+
+	if results := registry.teardown(nil); len(results) != 0 {
+		t.Errorf("resources removed twice: %+v", results)
+	}
+}
+
+// A user that no longer exists counts as removed.
+func TestCleanupDeletedUser(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"scim_resource_not_found","error_description":"User does not exist"}`))
+	}))
+	defer server.Close()
+	tokens := NewTokenSource("admin", "secret", server.URL)
+	tokens.set(TokenResponse{AccessToken: "token"})
+
+	registry := &cleanupRegistry{maxAttempts: 3, initialBackoff: time.Millisecond}
+	registry.add(userResource, "user", "smokeuser-test", func(tokens *TokenSource) TestResult {
+		return DeleteUser("user", tokens, server.URL, IdentityZone{})
+	})
+	results := registry.teardown(tokens)
+	if len(results) != 1 || results[0].Attempts != 1 || results[0].Result.HasError() {
+		t.Errorf("unexpected results %+v", results)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const cliUsage = `Usage: uaa-smoke run [options]
+
+Runs the smoke tests against a UAA identity zone and writes a report to standard output. The client secret is read
+from SMOKE_CLIENT_SECRET or, when not set, prompted for. Exits with 0 when all steps passed, 1 when a step failed or
+errored and 2 on invalid usage.
+
+Options:
+`
+
+// runCommand runs the command-line runner and returns the exit code. The only command is run, which runs the suite
+// against a single auth domain with the same steps as the service, configured by flags instead of VCAP_SERVICES.
+func runCommand(args []string) int {
+	// Standard output is reserved for the report.
+	logOutput = os.Stderr
+
+	options := &cliOptions{}
+	flags := newRunFlags(options)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, cliUsage)
+		flags.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "run" {
+		flags.Usage()
+		return 2
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if options.authDomain == "" || options.clientID == "" {
+		fmt.Fprintln(os.Stderr, "Both --auth-domain and --client-id are required")
+		return 2
+	}
+	if _, supported := reportContentTypes[options.format]; !supported {
+		fmt.Fprintf(os.Stderr, "Unsupported format '%s', use json, junit, tap or table\n", options.format)
+		return 2
+	}
+	filter, err := newStepFilter(splitList(options.only), splitList(options.exclude))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid --only or --exclude: "+err.Error())
+		return 2
+	}
+	clientSecret, err := readClientSecret()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+
+	test := &ssoTest{
+		serviceName:  options.service,
+		authDomain:   strings.TrimSuffix(options.authDomain, "/"),
+		clientId:     options.clientID,
+		clientSecret: clientSecret,
+		zone: IdentityZone{
+			ID:            options.zoneID,
+			Subdomain:     zoneSubdomain(options.authDomain),
+			SwitchHeaders: options.switchZoneHeaders,
+		},
+		clientApp:                clientApp(options.clientApp),
+		certificateExpiryWarning: time.Duration(options.certificateExpiryDays) * 24 * time.Hour,
+		certificateExpiryFail:    options.certificateExpiryFail,
+		mfa:                      options.mfa,
+		singleSignOn:             options.singleSignOn,
+		consent:                  consentDecision{approve: options.consent != "deny", scopes: splitList(options.consentScopes)},
+		checkConsentDenial:       options.checkConsentDenial,
+		filter:                   filter,
+	}
+	if options.journeysDir != "" {
+		test.journeys, test.journeysError = LoadJourneys(options.journeysDir)
+	}
+
+	flowsResult := test.runFlows(test.selection(test.filter))
+	results := MultiZoneTestResult{test.serviceName: {test.zone.Subdomain: flowsResult}}
+	if err := writeCliReport(os.Stdout, options.format, results); err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to write report: "+err.Error())
+		return 1
+	}
+	if flowsResult == nil || flowsResult.Verdict != StepPassed {
+		return 1
+	}
+	return 0
+}
+
+// cliOptions are the options of the run command. They default to the environment variables of the service.
+type cliOptions struct {
+	service               string
+	authDomain            string
+	clientID              string
+	zoneID                string
+	switchZoneHeaders     bool
+	clientApp             string
+	certificateExpiryDays int
+	certificateExpiryFail bool
+	mfa                   bool
+	singleSignOn          bool
+	consent               string
+	consentScopes         string
+	checkConsentDenial    bool
+	journeysDir           string
+	only                  string
+	exclude               string
+	format                string
+}
+
+func newRunFlags(options *cliOptions) *flag.FlagSet {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	flags.StringVar(&options.service, "service", "uaa-smoke", "name of the service in the report")
+	flags.StringVar(&options.authDomain, "auth-domain", os.Getenv("SMOKE_AUTH_DOMAIN"), "auth domain (UAA URL) of the identity zone, e.g. https://zone.login.example.com")
+	flags.StringVar(&options.clientID, "client-id", os.Getenv("SMOKE_CLIENT_ID"), "client to run the suite with (see README for its authorities)")
+	flags.StringVar(&options.zoneID, "zone-id", os.Getenv("SMOKE_ZONE_ID"), "identity zone id, for the zone switching headers")
+	flags.BoolVar(&options.switchZoneHeaders, "switch-zone-headers", envBool("SMOKE_ZONE_SWITCH_HEADERS"), "send the zone switching headers with admin requests")
+	flags.StringVar(&options.clientApp, "client-app", string(defaultClientApp), "URL of the client app (clientSso.go) with clients in the zone, for the browser steps (empty: skip these)")
+	flags.IntVar(&options.certificateExpiryDays, "cert-expiry-warning-days", envInt("SMOKE_CERT_EXPIRY_WARNING_DAYS", 30), "report identity provider certificates that expire within this number of days")
+	flags.BoolVar(&options.certificateExpiryFail, "cert-expiry-fail", envBool("SMOKE_CERT_EXPIRY_FAIL"), "fail the identity provider inventory on expiring certificates, instead of only reporting them")
+	flags.BoolVar(&options.mfa, "mfa", envBool("SMOKE_MFA"), "register the smoke user for MFA and check MFA")
+	flags.BoolVar(&options.singleSignOn, "sso-second-client", envBool("SMOKE_SSO_SECOND_CLIENT"), "check single sign-on to a second client")
+	flags.StringVar(&options.consent, "consent", envString("SMOKE_CONSENT", "approve"), "answer to the scope approval page: approve or deny")
+	flags.StringVar(&options.consentScopes, "consent-scopes", os.Getenv("SMOKE_CONSENT_SCOPES"), "comma separated scopes to approve (default: all)")
+	flags.BoolVar(&options.checkConsentDenial, "check-consent-denial", envBool("SMOKE_CONSENT_CHECK_DENIAL"), "check that denying the scope approval is reported as access_denied")
+	flags.StringVar(&options.journeysDir, "journeys", os.Getenv("SMOKE_JOURNEYS_DIR"), "directory with login journeys")
+	flags.StringVar(&options.only, "only", os.Getenv("SMOKE_INCLUDE_STEPS"), "comma separated steps and tags to run, with the steps they depend on, e.g. password,authcode-uaa (default: all)")
+	flags.StringVar(&options.exclude, "exclude", os.Getenv("SMOKE_EXCLUDE_STEPS"), "comma separated steps and tags not to run, e.g. adfs")
+	flags.StringVar(&options.format, "format", reportTable, "report format: json, junit, tap or table")
+	return flags
+}
+
+// readClientSecret reads the client secret from SMOKE_CLIENT_SECRET or, when standard input is a terminal, prompts
+// for it (without echo, where stty is available).
+func readClientSecret() (string, error) {
+	if secret := os.Getenv("SMOKE_CLIENT_SECRET"); secret != "" {
+		return secret, nil
+	}
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return "", errors.New("SMOKE_CLIENT_SECRET is not set")
+	}
+
+	fmt.Fprint(os.Stderr, "Client secret: ")
+	if stty("-echo") == nil {
+		defer func() {
+			stty("echo")
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+	secret, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	if secret = strings.TrimRight(secret, "\r\n"); secret == "" {
+		return "", errors.New("no client secret given")
+	}
+	return secret, nil
+}
+
+func stty(setting string) error {
+	command := exec.Command("stty", setting)
+	command.Stdin = os.Stdin
+	return command.Run()
+}
+
+func writeCliReport(w io.Writer, format string, results MultiZoneTestResult) error {
+	if format != reportJSON {
+		return writeReport(w, format, results)
+	}
+	js, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(js))
+	return err
+}
@@ -0,0 +1,43 @@
+package main
+
+import "strings"
+
+// clientApp is the base URL of a deployment of the clientSso.go app. The browser steps log in through its endpoints,
+// and its UAA clients live in a single identity zone, so every zone needs a deployment of its own.
+type clientApp string
+
+// Deployment of the app that the service used before client apps could be configured per zone.
+const defaultClientApp clientApp = "http://smoketests-resource.cf-tst.intranet.rws.nl"
+
+// Endpoints of the client app.
+const (
+	appRootPath      = "/"
+	appLogoutPath    = "/logout"
+	uaaResourcePath  = "/uaaLogin"
+	uaaCallbackPath  = "/uaaCallback"
+	uaa2ResourcePath = "/uaa2Login"
+	uaa2CallbackPath = "/uaa2Callback"
+	adfsResourcePath = "/adfsLogin"
+	adfsCallbackPath = "/adfsCallback"
+)
+
+// url returns the URL of an endpoint of the app.
+func (app clientApp) url(path string) string {
+	return strings.TrimSuffix(string(app), "/") + path
+}
+
+// clientAppsFromEnv reads the client app of every p-identity service from SMOKE_CLIENT_APPS, a comma separated list
+// of service=url. When it is not set and a single service is bound, that service uses the default client app.
+func clientAppsFromEnv(serviceNames []string) map[string]clientApp {
+	apps := make(map[string]clientApp)
+	for _, entry := range envList("SMOKE_CLIENT_APPS") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[1]) != "" {
+			apps[strings.TrimSpace(parts[0])] = clientApp(strings.TrimSpace(parts[1]))
+		}
+	}
+	if len(apps) == 0 && len(serviceNames) == 1 {
+		apps[serviceNames[0]] = defaultClientApp
+	}
+	return apps
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestClientAppsFromEnv(t *testing.T) {
+	defer os.Setenv("SMOKE_CLIENT_APPS", os.Getenv("SMOKE_CLIENT_APPS"))
+
+	os.Setenv("SMOKE_CLIENT_APPS", "")
+	if apps := clientAppsFromEnv([]string{"identity-a"}); apps["identity-a"] != defaultClientApp {
+		t.Errorf("a single service does not use the default client app: %v", apps)
+	}
+	if apps := clientAppsFromEnv([]string{"identity-a", "identity-b"}); len(apps) != 0 {
+		t.Errorf("several services use a client app: %v", apps)
+	}
+
+	os.Setenv("SMOKE_CLIENT_APPS", "identity-a=https://smoke-a.example.com/, identity-b = https://smoke-b.example.com,invalid")
+	apps := clientAppsFromEnv([]string{"identity-a", "identity-b", "identity-c"})
+	if apps["identity-a"].url(uaaCallbackPath) != "https://smoke-a.example.com/uaaCallback" {
+		t.Errorf("unexpected callback URL %s", apps["identity-a"].url(uaaCallbackPath))
+	}
+	if apps["identity-b"] != "https://smoke-b.example.com" || apps["identity-c"] != "" || len(apps) != 2 {
+		t.Errorf("unexpected client apps %v", apps)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// OAuthClient is a client registration as used by the UAA client registration API.
+// https://docs.cloudfoundry.org/api/uaa/version/4.7.0/index.html#clients
+type OAuthClient struct {
+	ClientID             string   `json:"client_id"`
+	ClientSecret         string   `json:"client_secret,omitempty"`
+	Name                 string   `json:"name,omitempty"`
+	Scope                []string `json:"scope,omitempty"`
+	ResourceIDs          []string `json:"resource_ids,omitempty"`
+	AuthorizedGrantTypes []string `json:"authorized_grant_types"`
+	RedirectURI          []string `json:"redirect_uri,omitempty"`
+	Authorities          []string `json:"authorities,omitempty"`
+	Autoapprove          []string `json:"autoapprove,omitempty"`
+	AccessTokenValidity  int      `json:"access_token_validity,omitempty"`
+	RefreshTokenValidity int      `json:"refresh_token_validity,omitempty"`
+	AllowedProviders     []string `json:"allowedproviders,omitempty"`
+	LastModified         int64    `json:"lastModified,omitempty"`
+}
+
+// oauthClientList is a page of client registrations.
+type oauthClientList struct {
+	Resources    []OAuthClient `json:"resources"`
+	TotalResults int           `json:"totalResults"`
+}
+
+type clientSecretChange struct {
+	ClientID  string `json:"clientId"`
+	OldSecret string `json:"oldSecret,omitempty"`
+	Secret    string `json:"secret"`
+}
+
+// CreateClient registers a new OAuth client. Requires the clients.write authority.
+func CreateClient(client OAuthClient, tokens *TokenSource, authDomain string, zone IdentityZone) (*OAuthClient, TestResult) {
+	// https://docs.cloudfoundry.org/api/uaa/version/4.7.0/index.html#create-6
+	return clientRequest(http.MethodPost, authDomain+"/oauth/clients", client, tokens, http.StatusCreated, zone)
+}
+
+// GetClient retrieves an OAuth client registration. Requires the clients.read authority.
+func GetClient(clientID string, tokens *TokenSource, authDomain string, zone IdentityZone) (*OAuthClient, TestResult) {
+	// https://docs.cloudfoundry.org/api/uaa/version/4.7.0/index.html#retrieve-3
+	return clientRequest(http.MethodGet, fmt.Sprintf("%s/oauth/clients/%s", authDomain, clientID), nil, tokens, http.StatusOK, zone)
+}
+
+// UpdateClient updates an OAuth client registration (but not its secret). Requires the clients.write authority.
+func UpdateClient(client OAuthClient, tokens *TokenSource, authDomain string, zone IdentityZone) (*OAuthClient, TestResult) {
+	// https://docs.cloudfoundry.org/api/uaa/version/4.7.0/index.html#update-5
+	client.ClientSecret = ""
+	return clientRequest(http.MethodPut, fmt.Sprintf("%s/oauth/clients/%s", authDomain, client.ClientID), client, tokens, http.StatusOK, zone)
+}
+
+// ChangeClientSecret rotates the secret of an OAuth client. Requires the clients.secret authority.
+func ChangeClientSecret(clientID, oldSecret, newSecret string, tokens *TokenSource, authDomain string, zone IdentityZone) TestResult {
+	// https://docs.cloudfoundry.org/api/uaa/version/4.7.0/index.html#change-secret
+	secretChange := clientSecretChange{ClientID: clientID, OldSecret: oldSecret, Secret: newSecret}
+	_, result := clientRequest(http.MethodPut, fmt.Sprintf("%s/oauth/clients/%s/secret", authDomain, clientID), secretChange, tokens, http.StatusOK, zone)
+	return result
+}
+
+// DeleteClient removes an OAuth client registration. Requires the clients.write authority.
+func DeleteClient(clientID string, tokens *TokenSource, authDomain string, zone IdentityZone) TestResult {
+	// https://docs.cloudfoundry.org/api/uaa/version/4.7.0/index.html#delete-6
+	_, result := clientRequest(http.MethodDelete, fmt.Sprintf("%s/oauth/clients/%s", authDomain, clientID), nil, tokens, http.StatusOK, zone)
+	return result
+}
+
+// FindClients returns the OAuth clients of which the client id starts with the given prefix. Requires the clients.read
+// authority.
+func FindClients(clientIDPrefix string, tokens *TokenSource, authDomain string, zone IdentityZone) ([]OAuthClient, TestResult) {
+	findClientsResult := defaultTestResult()
+
+	// https://docs.cloudfoundry.org/api/uaa/version/4.7.0/index.html#list-4
+	query := url.Values{}
+	query.Set("filter", fmt.Sprintf(`client_id sw "%s"`, clientIDPrefix))
+	findClientsRequest, err := http.NewRequest(http.MethodGet, authDomain+"/oauth/clients?"+query.Encode(), nil)
+	if err != nil {
+		findClientsResult.failWith(errorRequestFailed, err)
+		return nil, findClientsResult
+	}
+	findClientsRequest.Header.Add("Accept", "application/json")
+	zone.addHeaders(findClientsRequest)
+
+	findClientsResponse, err := doWithToken(findClientsRequest, tokens, &findClientsResult)
+	if err != nil {
+		findClientsResult.failWith(errorRequestFailed, err)
+		return nil, findClientsResult
+	}
+	defer findClientsResponse.Body.Close()
+
+	responseBuffer := new(bytes.Buffer)
+	responseBuffer.ReadFrom(findClientsResponse.Body)
+	statusCode := findClientsResponse.StatusCode
+	if statusCode != http.StatusOK {
+		findClientsResult.Result = false
+		findClientsResult.StatusCode = &statusCode
+		findClientsResult.ParseErrorResponse(responseBuffer)
+		return nil, findClientsResult
+	}
+
+	var list oauthClientList
+	if err = json.Unmarshal(responseBuffer.Bytes(), &list); err != nil {
+		findClientsResult.StatusCode = &statusCode
+		findClientsResult.failWith(errorInvalidResponse, err)
+		return nil, findClientsResult
+	}
+	return list.Resources, findClientsResult
+}
+
+// clientRequest performs a request against the client registration API and parses the returned client when the
+// response has the expected status code.
+func clientRequest(method, url string, body interface{}, tokens *TokenSource, expectedStatusCode int, zone IdentityZone) (*OAuthClient, TestResult) {
+	clientResult := defaultTestResult()
+
+	var requestBody *bytes.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			clientResult.failWith(errorRequestFailed, err)
+			return nil, clientResult
+		}
+		requestBody = bytes.NewReader(bodyBytes)
+	} else {
+		requestBody = bytes.NewReader(nil)
+	}
+
+	clientRequest, err := http.NewRequest(method, url, requestBody)
+	if err != nil {
+		clientResult.failWith(errorRequestFailed, err)
+		return nil, clientResult
+	}
+	clientRequest.Header.Add("Accept", "application/json")
+	zone.addHeaders(clientRequest)
+	if body != nil {
+		clientRequest.Header.Add("Content-Type", "application/json")
+	}
+
+	clientResponse, err := doWithToken(clientRequest, tokens, &clientResult)
+	if err != nil {
+		clientResult.failWith(errorRequestFailed, err)
+		return nil, clientResult
+	}
+	defer clientResponse.Body.Close()
+
+	responseBuffer := new(bytes.Buffer)
+	responseBuffer.ReadFrom(clientResponse.Body)
+	statusCode := clientResponse.StatusCode
+	if statusCode != expectedStatusCode {
+		clientResult.Result = false
+		clientResult.StatusCode = &statusCode
+		clientResult.ParseErrorResponse(responseBuffer)
+		return nil, clientResult
+	}
+
+	// The secret change endpoint does not return a client registration.
+	var client OAuthClient
+	if err = json.Unmarshal(responseBuffer.Bytes(), &client); err != nil || client.ClientID == "" {
+		return nil, clientResult
+	}
+	return &client, clientResult
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Configuration is read from environment variables, which can be set in the manifest of the app that incorporates
+// these tests.
+
+func envString(name, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// envList reads a comma separated list.
+func envList(name string) []string {
+	return splitList(os.Getenv(name))
+}
+
+// splitList splits a comma separated list.
+func splitList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func envBool(name string) bool {
+	value, err := strconv.ParseBool(os.Getenv(name))
+	return err == nil && value
+}
+
+func envInt(name string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// credentialString returns a string value from service credentials, or an empty string when it is not set.
+func credentialString(creds map[string]interface{}, key string) string {
+	value, _ := creds[key].(string)
+	return value
+}
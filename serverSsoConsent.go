@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/orangeglasses/cf-uaa-tests/browser"
+)
+
+const (
+	// Name of the submit buttons of the UAA scope approval form (values 'true' and 'false').
+	approvalButton = "user_oauth_approval"
+)
+
+// consentDecision is the answer to the UAA scope approval page, which is shown after login for clients that are not
+// autoapprove.
+type consentDecision struct {
+	approve bool
+
+	// Scopes to approve; when empty, all listed scopes are approved.
+	scopes []string
+}
+
+// consentDecisionFromEnv reads the consent decision from SMOKE_CONSENT ('approve' or 'deny') and
+// SMOKE_CONSENT_SCOPES (comma separated).
+func consentDecisionFromEnv() consentDecision {
+	return consentDecision{
+		approve: envString("SMOKE_CONSENT", "approve") != "deny",
+		scopes:  envList("SMOKE_CONSENT_SCOPES"),
+	}
+}
+
+// approvalForm returns the UAA scope approval form if the page is a scope approval page.
+// The approval form posts to /oauth/authorize and lists the requested scopes as checkboxes named scope.0, scope.1, ...
+// with values scope.<scope>, which are approved with the user_oauth_approval=true button or denied with the
+// user_oauth_approval=false button.
+func approvalForm(page *browser.Page) (*browser.Form, bool) {
+	form, err := page.Form(browser.FormSelector{Fields: []string{approvalButton}})
+	if err != nil {
+		return nil, false
+	}
+	return form, true
+}
+
+// answerConsent answers the scope approval form with the given decision and returns the resulting page.
+func answerConsent(session *browser.Session, form *browser.Form, decision consentDecision) (*browser.Page, error) {
+	if decision.approve {
+		for i := range form.Fields {
+			field := &form.Fields[i]
+			if field.Type != "checkbox" || !strings.HasPrefix(field.Name, "scope.") {
+				continue
+			}
+			field.Checked = len(decision.scopes) == 0 || containsString(decision.scopes, strings.TrimPrefix(field.Value, "scope."))
+		}
+		if err := form.Click(approvalButton, "true"); err != nil {
+			return nil, err
+		}
+	} else if err := form.Click(approvalButton, "false"); err != nil {
+		return nil, err
+	}
+	return session.Submit(form)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/orangeglasses/cf-uaa-tests/browser"
+)
+
+// The scope approval page of UAA, with every requested scope checked.
+const approvalPage = `<html><body>
+<form id="application_authorization" action="/oauth/authorize" method="POST">
+  <input type="hidden" name="X-Uaa-Csrf" value="csrf">
+  <input type="checkbox" name="scope.0" value="scope.openid" checked>
+  <input type="checkbox" name="scope.1" value="scope.profile" checked>
+  <input type="checkbox" name="scope.2" value="scope.smoketest.extinguish" checked>
+  <button type="submit" name="user_oauth_approval" value="true">Authorize</button>
+  <button type="submit" name="user_oauth_approval" value="false">Deny</button>
+</form>
+</body></html>`
+
+func TestAnswerConsent(t *testing.T) {
+	tests := []struct {
+		name     string
+		decision consentDecision
+		expected url.Values
+	}{
+		{"approve all", consentDecision{approve: true}, url.Values{
+			"X-Uaa-Csrf":          {"csrf"},
+			"scope.0":             {"scope.openid"},
+			"scope.1":             {"scope.profile"},
+			"scope.2":             {"scope.smoketest.extinguish"},
+			"user_oauth_approval": {"true"},
+		}},
+		{"approve some", consentDecision{approve: true, scopes: []string{"openid", "smoketest.extinguish"}}, url.Values{
+			"X-Uaa-Csrf":          {"csrf"},
+			"scope.0":             {"scope.openid"},
+			"scope.2":             {"scope.smoketest.extinguish"},
+			"user_oauth_approval": {"true"},
+		}},
+		{"deny", consentDecision{approve: false, scopes: []string{"openid"}}, url.Values{
+			"X-Uaa-Csrf":          {"csrf"},
+			"scope.0":             {"scope.openid"},
+			"scope.1":             {"scope.profile"},
+			"scope.2":             {"scope.smoketest.extinguish"},
+			"user_oauth_approval": {"false"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var submitted url.Values
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				if r.Method == http.MethodPost {
+					r.ParseForm()
+					submitted = r.PostForm
+					w.Write([]byte("<html><body>Done</body></html>"))
+					return
+				}
+				w.Write([]byte(approvalPage))
+			}))
+			defer server.Close()
+
+			session := browser.NewSession()
+			page, err := session.Get(server.URL + "/oauth/authorize?client_id=smoketest")
+			if err != nil {
+				t.Fatal(err)
+			}
+			form, ok := approvalForm(page)
+			if !ok {
+				t.Fatal("approval form not found")
+			}
+			if _, err := answerConsent(session, form, test.decision); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(submitted, test.expected) {
+				t.Errorf("submitted %v, expected %v", submitted, test.expected)
+			}
+		})
+	}
+}
+
+func TestApprovalFormNotFound(t *testing.T) {
+	pageURL, _ := url.Parse("https://login.example.com/login")
+	page := &browser.Page{URL: pageURL, Body: []byte(`<html><body><form method="post"><input name="username"></form></body></html>`)}
+	if _, ok := approvalForm(page); ok {
+		t.Error("login page taken for an approval page")
+	}
+}
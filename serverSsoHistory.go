@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RunRecord is the result of a single run of the suite against all zones.
+type RunRecord struct {
+	ID       int64               `json:"id"`
+	Started  time.Time           `json:"started"`
+	Finished time.Time           `json:"finished"`
+	Results  MultiZoneTestResult `json:"results"`
+}
+
+// RunSummary is a run without its results, as listed by /results, with the verdict and the number of steps by status
+// over all zones.
+type RunSummary struct {
+	ID       int64         `json:"id"`
+	Started  time.Time     `json:"started"`
+	Finished time.Time     `json:"finished"`
+	Result   bool          `json:"result"`
+	Verdict  StepStatus    `json:"verdict"`
+	Summary  StatusSummary `json:"summary"`
+}
+
+// StepUptime is the share of the retained runs in which a step ran that it succeeded.
+type StepUptime struct {
+	Runs      int     `json:"runs"`
+	Successes int     `json:"successes"`
+	Uptime    float64 `json:"uptime"`
+}
+
+// HistoryResponse is returned by /results: the retained runs (newest first) and the uptime of every step over them,
+// by service, zone and step.
+type HistoryResponse struct {
+	Runs   []RunSummary                                 `json:"runs"`
+	Uptime map[string]map[string]map[string]*StepUptime `json:"uptime"`
+}
+
+// resultHistory keeps the last runs in a ring buffer.
+type resultHistory struct {
+	mutex   sync.Mutex
+	records []RunRecord
+	next    int
+	lastID  int64
+}
+
+var history = newResultHistory(envInt("SMOKE_HISTORY_SIZE", 100))
+
+func newResultHistory(size int) *resultHistory {
+	if size < 1 {
+		size = 1
+	}
+	return &resultHistory{records: make([]RunRecord, 0, size)}
+}
+
+func init() {
+	http.HandleFunc("/results", history.handleResults)
+	http.HandleFunc("/results/", history.handleResult)
+}
+
+// add stores a run, replacing the oldest run when the buffer is full.
+func (h *resultHistory) add(started, finished time.Time, results MultiZoneTestResult) RunRecord {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.lastID++
+	record := RunRecord{ID: h.lastID, Started: started, Finished: finished, Results: results}
+	if len(h.records) < cap(h.records) {
+		h.records = append(h.records, record)
+	} else {
+		h.records[h.next] = record
+	}
+	h.next = (h.next + 1) % cap(h.records)
+	return record
+}
+
+// runs returns the retained runs, newest first.
+func (h *resultHistory) runs() []RunRecord {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	runs := make([]RunRecord, 0, len(h.records))
+	for i := 1; i <= len(h.records); i++ {
+		runs = append(runs, h.records[(h.next-i+len(h.records))%len(h.records)])
+	}
+	return runs
+}
+
+// get returns a retained run by id.
+func (h *resultHistory) get(id int64) (RunRecord, bool) {
+	for _, record := range h.runs() {
+		if record.ID == id {
+			return record, true
+		}
+	}
+	return RunRecord{}, false
+}
+
+// latest returns the last run, if any.
+func (h *resultHistory) latest() (RunRecord, bool) {
+	runs := h.runs()
+	if len(runs) == 0 {
+		return RunRecord{}, false
+	}
+	return runs[0], true
+}
+
+func (h *resultHistory) handleResults(w http.ResponseWriter, r *http.Request) {
+	response := HistoryResponse{Runs: []RunSummary{}, Uptime: make(map[string]map[string]map[string]*StepUptime)}
+	for _, record := range h.runs() {
+		summary := RunSummary{ID: record.ID, Started: record.Started, Finished: record.Finished, Result: true}
+		for service, zones := range record.Results {
+			if response.Uptime[service] == nil {
+				response.Uptime[service] = make(map[string]map[string]*StepUptime)
+			}
+			for zone, flowsResult := range zones {
+				if response.Uptime[service][zone] == nil {
+					response.Uptime[service][zone] = make(map[string]*StepUptime)
+				}
+				if flowsResult != nil {
+					summary.Summary.add(flowsResult.Summary)
+				}
+				for step, result := range stepResults(flowsResult) {
+					uptime := response.Uptime[service][zone][step]
+					if uptime == nil {
+						uptime = &StepUptime{}
+						response.Uptime[service][zone][step] = uptime
+					}
+					uptime.Runs++
+					if result.HasError() {
+						summary.Result = false
+					} else {
+						uptime.Successes++
+					}
+					uptime.Uptime = float64(uptime.Successes) / float64(uptime.Runs)
+				}
+			}
+		}
+		summary.Verdict = summary.Summary.verdict()
+		response.Runs = append(response.Runs, summary)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleResult returns a retained run by id, or the last run (/results/latest), in the report format requested by the
+// format query parameter or the Accept header.
+func (h *resultHistory) handleResult(w http.ResponseWriter, r *http.Request) {
+	format, supported := reportFormat(r)
+	if !supported {
+		writeJSON(w, http.StatusNotAcceptable, authError{Error: "not_acceptable", ErrorDescription: "Supported formats are json, junit, tap and table"})
+		return
+	}
+
+	var record RunRecord
+	found := false
+	if id := strings.TrimPrefix(r.URL.Path, "/results/"); id == "latest" {
+		record, found = h.latest()
+	} else {
+		runID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, authError{Error: "invalid_request", ErrorDescription: "Invalid run id"})
+			return
+		}
+		record, found = h.get(runID)
+	}
+	if !found {
+		writeJSON(w, http.StatusNotFound, authError{Error: "not_found", ErrorDescription: "Run is not (or no longer) retained"})
+		return
+	}
+
+	if format == reportJSON {
+		writeJSON(w, http.StatusOK, record)
+		return
+	}
+	w.Header().Set("Content-Type", reportContentTypes[format])
+	if err := writeReport(w, format, record.Results); err != nil {
+		logf("Unable to write report: %s", err.Error())
+	}
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, value interface{}) {
+	js, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(js)
+}
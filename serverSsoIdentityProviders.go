@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type identityProvider struct {
+	ID             string `json:"id"`
+	OriginKey      string `json:"originKey"`
+	Type           string `json:"type"`
+	Name           string `json:"name"`
+	Active         bool   `json:"active"`
+	Config         string `json:"config"`
+	IdentityZoneID string `json:"identityZoneId"`
+}
+
+type samlIdentityProviderConfig struct {
+	MetaDataLocation string `json:"metaDataLocation"`
+}
+
+// IdentityProviderInfo describes a configured identity provider and, for SAML providers, the expiry of its
+// metadata and signing certificates.
+type IdentityProviderInfo struct {
+	OriginKey           string            `json:"originKey"`
+	Type                string            `json:"type"`
+	Name                string            `json:"name"`
+	Active              bool              `json:"active"`
+	MetadataValidUntil  *time.Time        `json:"metadataValidUntil,omitempty"`
+	SigningCertificates []CertificateInfo `json:"signingCertificates,omitempty"`
+	Warnings            []string          `json:"warnings,omitempty"`
+}
+
+// expiry returns the earliest expiry of the metadata and signing certificates of a SAML provider, or the zero time
+// when none is known.
+func (info IdentityProviderInfo) expiry() time.Time {
+	var expiry time.Time
+	if info.MetadataValidUntil != nil {
+		expiry = *info.MetadataValidUntil
+	}
+	for _, certificate := range info.SigningCertificates {
+		if expiry.IsZero() || certificate.NotAfter.Before(expiry) {
+			expiry = certificate.NotAfter
+		}
+	}
+	return expiry
+}
+
+type CertificateInfo struct {
+	Subject  string    `json:"subject"`
+	NotAfter time.Time `json:"notAfter"`
+}
+
+// SAML metadata, only the parts we need to determine expiry.
+// https://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf
+type samlEntityDescriptor struct {
+	ValidUntil     string              `xml:"validUntil,attr"`
+	KeyDescriptors []samlKeyDescriptor `xml:"IDPSSODescriptor>KeyDescriptor"`
+}
+
+type samlKeyDescriptor struct {
+	Use          string   `xml:"use,attr"`
+	Certificates []string `xml:"KeyInfo>X509Data>X509Certificate"`
+}
+
+// getIdentityProviders lists the identity providers of a zone, including their configuration. Requires the
+// idps.read authority.
+func getIdentityProviders(tokens *TokenSource, authDomain string, zone IdentityZone, result *TestResult) ([]identityProvider, error) {
+	// https://docs.cloudfoundry.org/api/uaa/version/4.7.0/index.html#retrieve-all
+	responseBuffer, err := getWithToken(authDomain+"/identity-providers?rawConfig=true", tokens, zone, result)
+	if err != nil {
+		return nil, err
+	}
+	var providers []identityProvider
+	err = json.Unmarshal(responseBuffer.Bytes(), &providers)
+	return providers, err
+}
+
+// IdentityProviderInventory lists every identity provider configured in the zone. The metadata or a signing
+// certificate of a SAML provider that expires within the given window is reported as a warning, which only fails the
+// test when failOnWarnings is set.
+func IdentityProviderInventory(tokens *TokenSource, authDomain string, zone IdentityZone, expiryWarning time.Duration, failOnWarnings bool) ([]IdentityProviderInfo, TestResult) {
+	inventoryResult := defaultTestResult()
+
+	providers, err := getIdentityProviders(tokens, authDomain, zone, &inventoryResult)
+	if err != nil {
+		inventoryResult.failWith(errorRequestFailed, err)
+		return nil, inventoryResult
+	}
+
+	warnBefore := time.Now().Add(expiryWarning)
+	var inventory []IdentityProviderInfo
+	var warnings []string
+	for _, provider := range providers {
+		info := IdentityProviderInfo{OriginKey: provider.OriginKey, Type: provider.Type, Name: provider.Name, Active: provider.Active}
+		if provider.Type == "saml" {
+			inspectSamlProvider(provider, &info, warnBefore, &inventoryResult)
+		}
+		for _, warning := range info.Warnings {
+			warnings = append(warnings, fmt.Sprintf("%s: %s", provider.OriginKey, warning))
+		}
+		inventory = append(inventory, info)
+	}
+
+	inventoryResult.Warnings = warnings
+	if len(warnings) > 0 && failOnWarnings {
+		inventoryResult.Result = false
+		inventoryResult.Error = "identity_provider_warnings"
+		inventoryResult.ErrorDescription = strings.Join(warnings, "; ")
+	}
+	return inventory, inventoryResult
+}
+
+// inspectSamlProvider reads the metadata of a SAML provider (inline XML or a URL) and records the expiry of the
+// metadata and its signing certificates.
+func inspectSamlProvider(provider identityProvider, info *IdentityProviderInfo, warnBefore time.Time, result *TestResult) {
+	var config samlIdentityProviderConfig
+	if err := json.Unmarshal([]byte(provider.Config), &config); err != nil {
+		info.Warnings = append(info.Warnings, "unable to parse configuration: "+err.Error())
+		return
+	}
+
+	metadata := strings.TrimSpace(config.MetaDataLocation)
+	if strings.HasPrefix(metadata, "http://") || strings.HasPrefix(metadata, "https://") {
+		request, err := http.NewRequest(http.MethodGet, metadata, nil)
+		if err != nil {
+			info.Warnings = append(info.Warnings, "invalid metadata URL: "+err.Error())
+			return
+		}
+		response, err := do(request, result)
+		if err != nil {
+			info.Warnings = append(info.Warnings, "unable to fetch metadata: "+err.Error())
+			return
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			info.Warnings = append(info.Warnings, fmt.Sprintf("unable to fetch metadata: status %d", response.StatusCode))
+			return
+		}
+		metadataBuffer := new(bytes.Buffer)
+		metadataBuffer.ReadFrom(response.Body)
+		metadata = metadataBuffer.String()
+	}
+
+	var entity samlEntityDescriptor
+	if err := xml.Unmarshal([]byte(metadata), &entity); err != nil {
+		info.Warnings = append(info.Warnings, "unable to parse metadata: "+err.Error())
+		return
+	}
+
+	if entity.ValidUntil != "" {
+		if validUntil, err := time.Parse(time.RFC3339, entity.ValidUntil); err == nil {
+			info.MetadataValidUntil = &validUntil
+			if validUntil.Before(warnBefore) {
+				info.Warnings = append(info.Warnings, fmt.Sprintf("metadata expires at %s", validUntil.Format(time.RFC3339)))
+			}
+		}
+	}
+
+	for _, keyDescriptor := range entity.KeyDescriptors {
+		// A key descriptor without 'use' is used for both signing and encryption.
+		if keyDescriptor.Use != "" && keyDescriptor.Use != "signing" {
+			continue
+		}
+		for _, encoded := range keyDescriptor.Certificates {
+			der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+			if err != nil {
+				info.Warnings = append(info.Warnings, "unable to decode signing certificate: "+err.Error())
+				continue
+			}
+			certificate, err := x509.ParseCertificate(der)
+			if err != nil {
+				info.Warnings = append(info.Warnings, "unable to parse signing certificate: "+err.Error())
+				continue
+			}
+			info.SigningCertificates = append(info.SigningCertificates, CertificateInfo{Subject: certificate.Subject.String(), NotAfter: certificate.NotAfter})
+			if certificate.NotAfter.Before(warnBefore) {
+				info.Warnings = append(info.Warnings, fmt.Sprintf("signing certificate '%s' expires at %s", certificate.Subject.String(), certificate.NotAfter.Format(time.RFC3339)))
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Metadata that expires within the window is a warning, which only fails the inventory when configured to.
+func TestIdentityProviderInventoryWarnings(t *testing.T) {
+	validUntil := time.Now().Add(10 * 24 * time.Hour).UTC().Truncate(time.Second)
+	metadata := fmt.Sprintf(`<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" validUntil="%s"/>`, validUntil.Format(time.RFC3339))
+	config, _ := json.Marshal(samlIdentityProviderConfig{MetaDataLocation: metadata})
+	providers, _ := json.Marshal([]identityProvider{
+		{OriginKey: "uaa", Type: "uaa", Active: true},
+		{OriginKey: "adfs", Type: "saml", Active: true, Config: string(config)},
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(providers)
+	}))
+	defer server.Close()
+
+	tokens := NewTokenSource("admin", "secret", server.URL)
+	tokens.set(TokenResponse{AccessToken: "token"})
+
+	inventory, result := IdentityProviderInventory(tokens, server.URL, IdentityZone{}, 30*24*time.Hour, false)
+	if result.HasError() || len(result.Warnings) != 1 || !strings.HasPrefix(result.Warnings[0], "adfs: metadata expires") {
+		t.Errorf("unexpected result of the inventory: %+v", result)
+	}
+	if len(inventory) != 2 || !inventory[1].expiry().Equal(validUntil) {
+		t.Errorf("unexpected inventory %+v", inventory)
+	}
+
+	_, result = IdentityProviderInventory(tokens, server.URL, IdentityZone{}, 30*24*time.Hour, true)
+	if !result.HasError() || result.Error != "identity_provider_warnings" {
+		t.Errorf("unexpected result of the inventory that fails on warnings: %+v", result)
+	}
+
+	_, result = IdentityProviderInventory(tokens, server.URL, IdentityZone{}, 24*time.Hour, true)
+	if result.HasError() || len(result.Warnings) != 0 {
+		t.Errorf("unexpected result of the inventory outside the window: %+v", result)
+	}
+
+	registry := &metricsRegistry{steps: make(map[stepKey]*stepMetrics), providerExpiry: make(map[providerKey]time.Time)}
+	inventoryResult := TestResult{Result: true, Warnings: []string{"adfs: metadata expires"}}
+	registry.record(MultiZoneTestResult{"sso": {"uaa": {IdentityProviderInventory: &inventoryResult, IdentityProviders: inventory}}})
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range []string{
+		`uaa_smoke_step_success{service="sso",zone="uaa",step="identityProviderInventory"} 1`,
+		`uaa_smoke_step_warnings{service="sso",zone="uaa",step="identityProviderInventory"} 1`,
+		fmt.Sprintf(`uaa_smoke_identity_provider_expiry_timestamp_seconds{service="sso",zone="uaa",origin="adfs"} %d`, validUntil.Unix()),
+	} {
+		if !strings.Contains(recorder.Body.String(), line+"\n") {
+			t.Errorf("metrics do not contain %s:\n%s", line, recorder.Body.String())
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/orangeglasses/cf-uaa-tests/browser"
+)
+
+// Journey is a scripted login journey, read from a YAML or JSON file. It allows login pages of other identity
+// providers (Azure AD, Okta, LDAP, ...) to be tested without code changes. For example:
+//
+//	name: azure-ad
+//	steps:
+//	  - visit: https://smoketests-resource.example.com/azureLogin
+//	  - expectForm: {fields: [loginfmt, passwd]}
+//	  - fill: {loginfmt: "${AZURE_USERNAME}", passwd: "${AZURE_PASSWORD}"}
+//	  - submit: {}
+//	  - followAutoPost: true
+//	  - expectStatus: 200
+//	  - expectToken: true
+//
+// Values can refer to environment variables and to ${smokeUsername} and ${smokePassword}, the temporary UAA user.
+type Journey struct {
+	Name  string        `yaml:"name"`
+	Steps []JourneyStep `yaml:"steps"`
+}
+
+// JourneyStep is a single step of a journey. Each step sets exactly one of its fields.
+type JourneyStep struct {
+	// Navigate to a URL.
+	Visit string `yaml:"visit"`
+
+	// Expect a form on the current page, picked by selector and/or field names. It becomes the form that fill and
+	// submit act upon.
+	ExpectForm *JourneyForm `yaml:"expectForm"`
+
+	// Fill in fields of the current form.
+	Fill map[string]string `yaml:"fill"`
+
+	// Check or uncheck checkboxes of the current form.
+	Check map[string]bool `yaml:"check"`
+
+	// Submit the current form, optionally with a specific button.
+	Submit *JourneySubmit `yaml:"submit"`
+
+	// Submit the auto-post form (e.g. SAML) of the current page.
+	FollowAutoPost bool `yaml:"followAutoPost"`
+
+	// Expectations about the current page.
+	ExpectStatus int    `yaml:"expectStatus"`
+	ExpectURL    string `yaml:"expectUrl"`
+	ExpectText   string `yaml:"expectText"`
+	ExpectParam  string `yaml:"expectParam"`
+	ExpectToken  bool   `yaml:"expectToken"`
+}
+
+// fields returns the names of the fields that a step sets.
+func (step JourneyStep) fields() []string {
+	var fields []string
+	for name, set := range map[string]bool{
+		"visit":          step.Visit != "",
+		"expectForm":     step.ExpectForm != nil,
+		"fill":           len(step.Fill) > 0,
+		"check":          len(step.Check) > 0,
+		"submit":         step.Submit != nil,
+		"followAutoPost": step.FollowAutoPost,
+		"expectStatus":   step.ExpectStatus != 0,
+		"expectUrl":      step.ExpectURL != "",
+		"expectText":     step.ExpectText != "",
+		"expectParam":    step.ExpectParam != "",
+		"expectToken":    step.ExpectToken,
+	} {
+		if set {
+			fields = append(fields, name)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+type JourneyForm struct {
+	Selector string   `yaml:"selector"`
+	Fields   []string `yaml:"fields"`
+}
+
+type JourneySubmit struct {
+	Button string `yaml:"button"`
+	Value  string `yaml:"value"`
+}
+
+// LoadJourneys reads all journey files (*.yml, *.yaml and *.json) in a directory. JSON is read as YAML, of which it
+// is a subset.
+func LoadJourneys(dir string) ([]Journey, error) {
+	var journeys []Journey
+	for _, pattern := range []string{"*.yml", "*.yaml", "*.json"} {
+		files, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			journeyBytes, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			var journey Journey
+			if err = yaml.UnmarshalStrict(journeyBytes, &journey); err != nil {
+				return nil, fmt.Errorf("%s: %s", file, err.Error())
+			}
+			if journey.Name == "" {
+				journey.Name = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+			}
+			for i, step := range journey.Steps {
+				if fields := step.fields(); len(fields) != 1 {
+					return nil, fmt.Errorf("%s: step %d must set exactly one field, it sets %d (%s)", file, i+1, len(fields), strings.Join(fields, ", "))
+				}
+			}
+			journeys = append(journeys, journey)
+		}
+	}
+	return journeys, nil
+}
+
+// RunJourney runs the steps of a journey in a new browser session. Variables in step values are expanded from vars
+// and the environment.
+func RunJourney(journey Journey, vars map[string]string) (journeyResult TestResult) {
+	journeyResult = defaultTestResult()
+
+	expand := func(value string) string {
+		return os.Expand(value, func(name string) string {
+			if value, exists := vars[name]; exists {
+				return value
+			}
+			return os.Getenv(name)
+		})
+	}
+
+	session := browser.NewSession()
+	defer traceSession(session, 0, &journeyResult)
+	// Auto-post forms are submitted by an explicit followAutoPost step.
+	session.FollowAutoPost = false
+
+	var page *browser.Page
+	var form *browser.Form
+	for i, step := range journey.Steps {
+		var err error
+		page, form, err = runJourneyStep(session, step, page, form, expand)
+		if err != nil {
+			journeyResult.Result = false
+			journeyResult.Error = "journey_step_failed"
+			journeyResult.ErrorDescription = redactText(fmt.Sprintf("Step %d of journey '%s': %s", i+1, journey.Name, err.Error()))
+			if page != nil {
+				statusCode := page.StatusCode
+				journeyResult.StatusCode = &statusCode
+			}
+			return journeyResult
+		}
+	}
+	return journeyResult
+}
+
+func runJourneyStep(session *browser.Session, step JourneyStep, page *browser.Page, form *browser.Form, expand func(string) string) (*browser.Page, *browser.Form, error) {
+	if page == nil && step.Visit == "" {
+		return nil, nil, errors.New("The first step must visit a URL")
+	}
+
+	switch {
+	case step.Visit != "":
+		page, err := session.Get(expand(step.Visit))
+		return page, nil, err
+
+	case step.ExpectForm != nil:
+		form, err := page.Form(browser.FormSelector{Selector: step.ExpectForm.Selector, Fields: step.ExpectForm.Fields})
+		return page, form, err
+
+	case len(step.Fill) > 0:
+		if form == nil {
+			return page, nil, errors.New("No form to fill, use expectForm first")
+		}
+		for name, value := range step.Fill {
+			if !form.Has(name) {
+				return page, form, fmt.Errorf("No field '%s' in form", name)
+			}
+			form.Set(name, expand(value))
+		}
+		return page, form, nil
+
+	case len(step.Check) > 0:
+		if form == nil {
+			return page, nil, errors.New("No form to check fields of, use expectForm first")
+		}
+		for name, checked := range step.Check {
+			form.Check(name, "", checked)
+		}
+		return page, form, nil
+
+	case step.Submit != nil:
+		if form == nil {
+			return page, nil, errors.New("No form to submit, use expectForm first")
+		}
+		if step.Submit.Button != "" {
+			if err := form.Click(step.Submit.Button, step.Submit.Value); err != nil {
+				return page, form, err
+			}
+		}
+		page, err := session.Submit(form)
+		return page, nil, err
+
+	case step.FollowAutoPost:
+		autoPostForm, found := page.AutoPostForm()
+		if !found {
+			return page, nil, errors.New("No auto-post form in page " + redactURL(page.URL))
+		}
+		page, err := session.Submit(autoPostForm)
+		return page, nil, err
+
+	case step.ExpectStatus != 0:
+		if page.StatusCode != step.ExpectStatus {
+			return page, form, fmt.Errorf("Expected status %d, got %d at %s", step.ExpectStatus, page.StatusCode, redactURL(page.URL))
+		}
+
+	case step.ExpectURL != "":
+		if !strings.HasPrefix(page.URL.String(), expand(step.ExpectURL)) {
+			return page, form, fmt.Errorf("Expected URL %s, got %s", expand(step.ExpectURL), redactURL(page.URL))
+		}
+
+	case step.ExpectText != "":
+		if !strings.Contains(page.Text(), expand(step.ExpectText)) {
+			return page, form, fmt.Errorf("Expected text '%s' in page %s", expand(step.ExpectText), redactURL(page.URL))
+		}
+
+	case step.ExpectParam != "":
+		if _, found := session.Param(step.ExpectParam); !found {
+			return page, form, fmt.Errorf("Expected parameter '%s' in a redirect", step.ExpectParam)
+		}
+
+	case step.ExpectToken:
+		var token TokenResponse
+		if page.StatusCode != http.StatusOK || page.ContentType() != "application/json" {
+			return page, form, fmt.Errorf("Expected JSON token, got status %d (%s) at %s", page.StatusCode, page.ContentType(), redactURL(page.URL))
+		}
+		if err := json.Unmarshal(page.Body, &token); err != nil || token.AccessToken == "" {
+			return page, form, fmt.Errorf("Expected access_token in response from %s", redactURL(page.URL))
+		}
+
+	default:
+		return page, form, errors.New("Empty step")
+	}
+	return page, form, nil
+}
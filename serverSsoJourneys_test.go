@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeJourney(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "journeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "login.yml"), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestLoadJourneys(t *testing.T) {
+	dir := writeJourney(t, `steps:
+  - visit: https://app.example.com/uaaLogin
+  - expectForm: {fields: [username, password]}
+  - fill: {username: "${smokeUsername}", password: "${smokePassword}"}
+  - submit: {}
+  - expectStatus: 200
+  - expectToken: true
+`)
+	defer os.RemoveAll(dir)
+
+	journeys, err := LoadJourneys(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(journeys) != 1 || journeys[0].Name != "login" || len(journeys[0].Steps) != 6 {
+		t.Errorf("unexpected journeys: %+v", journeys)
+	}
+}
+
+func TestLoadJourneysRejectsStepWithSeveralFields(t *testing.T) {
+	dir := writeJourney(t, `steps:
+  - visit: https://app.example.com/uaaLogin
+  - {expectStatus: 200, expectToken: true}
+`)
+	defer os.RemoveAll(dir)
+
+	_, err := LoadJourneys(dir)
+	if err == nil || !strings.Contains(err.Error(), "step 2 must set exactly one field, it sets 2 (expectStatus, expectToken)") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
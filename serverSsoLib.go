@@ -3,6 +3,13 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/orangeglasses/cf-uaa-tests/browser"
 )
 
 type TokenResponse struct {
@@ -12,6 +19,17 @@ type TokenResponse struct {
 	RefreshToken string `json:"refresh_token"`
 	Scope        string `json:"scope"`
 	JwtID        string `json:"jti"`
+	IDToken      string `json:"id_token,omitempty"`
+
+	// Absolute expiry, computed from ExpiresIn (the lifetime in seconds) when the token was received.
+	Expiry time.Time `json:"-"`
+}
+
+// setExpiry computes the absolute expiry of a token that was received at the given time.
+func (t *TokenResponse) setExpiry(receivedAt time.Time) {
+	if t.ExpiresIn > 0 {
+		t.Expiry = receivedAt.Add(time.Duration(t.ExpiresIn) * time.Second)
+	}
 }
 
 func (result *TestResult) ParseErrorResponse(responseBuffer *bytes.Buffer) {
@@ -31,10 +49,167 @@ type TestResult struct {
 	StatusCode       *int   `json:"statusCode,omitempty"`
 	Error            string `json:"error,omitempty"`
 	ErrorDescription string `json:"errorDescription,omitempty"`
+	FinalURL         string `json:"finalUrl,omitempty"`
+	BodyExcerpt      string `json:"bodyExcerpt,omitempty"`
+
+	// Problems that do not fail the step (yet), e.g. a certificate that expires soon.
+	Warnings []string `json:"warnings,omitempty"`
+
+	// Status of the step (set when the run is complete) and the reason for a status other than passed or failed.
+	Status StepStatus `json:"status,omitempty"`
+	Reason string     `json:"reason,omitempty"`
+
+	// Start and duration (in nanoseconds, recorded by finished) of the test, and the HTTP requests it made, with
+	// sensitive parameters redacted.
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	Trace    []browser.Hop `json:"trace,omitempty"`
+}
+
+// Parameters that are redacted from URLs before they are recorded in test results.
+var sensitiveParams = []string{"code", "access_token", "id_token", "refresh_token", "password", "client_secret", "SAMLResponse", "SAMLRequest"}
+
+const maxBodyExcerptLength = 512
+
+// Error of a test of which a request could not be sent or a page could not be processed. The error itself, which is
+// free-form text, goes in the error description: the error of a result is a code, as it labels metrics and alerts.
+const errorRequestFailed = "request_failed"
+
+// Error of a test of which a request got a successful response that could not be parsed, e.g. an HTML page from a
+// proxy instead of JSON.
+const errorInvalidResponse = "invalid_response"
+
+var textURLPattern = regexp.MustCompile(`https?://[^\s"'<>]+`)
+
+// redactURL returns a URL with the values of sensitive query and fragment parameters replaced.
+func redactURL(u *url.URL) string {
+	redacted := *u
+	redacted.User = nil
+	redacted.RawQuery = redactParams(u.RawQuery)
+	redacted.Fragment = redactParams(u.Fragment)
+	redacted.RawFragment = ""
+	return redacted.String()
+}
+
+// redactText redacts the URLs in a text, e.g. an error message, as redactURL does.
+func redactText(text string) string {
+	return textURLPattern.ReplaceAllStringFunc(text, func(rawURL string) string {
+		if u, err := url.Parse(rawURL); err == nil {
+			return redactURL(u)
+		}
+		return rawURL
+	})
+}
+
+func redactParams(rawParams string) string {
+	params, err := url.ParseQuery(rawParams)
+	if err != nil || rawParams == "" {
+		return rawParams
+	}
+	for _, param := range sensitiveParams {
+		if _, exists := params[param]; exists {
+			params.Set(param, "REDACTED")
+		}
+	}
+	return params.Encode()
+}
+
+// bodyExcerpt returns the start of a response body with whitespace collapsed, to record in a test result.
+func bodyExcerpt(body []byte) string {
+	excerpt := []rune(strings.Join(strings.Fields(string(body)), " "))
+	if len(excerpt) > maxBodyExcerptLength {
+		return string(excerpt[:maxBodyExcerptLength]) + "..."
+	}
+	return string(excerpt)
 }
 
 func defaultTestResult() TestResult {
-	return TestResult{Result: true}
+	return TestResult{Result: true, Started: time.Now()}
+}
+
+// passed returns a successful result for a test that was expected to fail in this way, keeping its start time and
+// trace.
+func (r TestResult) passed() TestResult {
+	passedResult := defaultTestResult()
+	passedResult.Started = r.Started
+	passedResult.Trace = r.Trace
+	return passedResult
+}
+
+// finished records the duration of the test (since its result was created) and returns the result to store in the
+// results of the run.
+func finished(r TestResult) *TestResult {
+	if !r.Started.IsZero() {
+		r.Duration = time.Since(r.Started)
+	}
+	return &r
+}
+
+// requestTimeout bounds every request of the tests (SMOKE_HTTP_TIMEOUT_SECONDS), so a hanging server fails a step
+// instead of hanging the run.
+var requestTimeout = time.Duration(envInt("SMOKE_HTTP_TIMEOUT_SECONDS", 30)) * time.Second
+
+// httpClient sends the requests of the tests that do not use a browser session.
+var httpClient = &http.Client{Timeout: requestTimeout}
+
+func init() {
+	browser.Timeout = requestTimeout
+}
+
+// do sends a request for a test and records the request in the trace of its result (when not nil).
+func do(request *http.Request, result *TestResult) (*http.Response, error) {
+	response, hop, err := browser.Do(httpClient, request)
+	if result != nil {
+		result.Trace = append(result.Trace, redactHops([]browser.Hop{hop})...)
+	}
+	return response, err
+}
+
+// traceSession records the requests that a browser session made since the given hop in the trace of a test result.
+// It is deferred at the start of a browser test: defer traceSession(session, len(session.Hops), &result).
+func traceSession(session *browser.Session, firstHop int, result *TestResult) {
+	if firstHop < len(session.Hops) {
+		result.Trace = append(result.Trace, redactHops(session.Hops[firstHop:])...)
+	}
+}
+
+func redactHops(hops []browser.Hop) []browser.Hop {
+	redacted := make([]browser.Hop, len(hops))
+	for i, hop := range hops {
+		if hopUrl, err := url.Parse(hop.URL); err == nil {
+			hop.URL = redactURL(hopUrl)
+		}
+		if location, err := url.Parse(hop.Location); err == nil && hop.Location != "" {
+			hop.Location = redactURL(location)
+		}
+		// The error of a request that got no response names its URL.
+		hop.Error = redactText(hop.Error)
+		redacted[i] = hop
+	}
+	return redacted
+}
+
+// failAt marks a result as failed with an error code and description, recording the status, final URL and an excerpt
+// of the body of the page the test ended at (when not nil). URLs in the description are redacted. It returns the
+// result.
+func (r *TestResult) failAt(page *browser.Page, code, description string) TestResult {
+	r.Result = false
+	r.Error = code
+	r.ErrorDescription = redactText(description)
+	if page != nil {
+		statusCode := page.StatusCode
+		r.StatusCode = &statusCode
+		r.FinalURL = redactURL(page.URL)
+		r.BodyExcerpt = bodyExcerpt(page.Body)
+	}
+	return *r
+}
+
+// failWith marks a result as failed with an error code and, as description, the redacted text of an error.
+func (r *TestResult) failWith(code string, err error) {
+	r.Result = false
+	r.Error = code
+	r.ErrorDescription = redactText(err.Error())
 }
 
 func (r TestResult) HasError() bool {
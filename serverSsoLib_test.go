@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFailWithRedactsURLs(t *testing.T) {
+	result := defaultTestResult()
+	result.failWith(errorRequestFailed, errors.New(`Get "https://app.example.com/callback?code=abc123&state=xyz": context deadline exceeded`))
+	if result.Error != errorRequestFailed || !result.HasError() {
+		t.Errorf("unexpected error %q", result.Error)
+	}
+	if strings.Contains(result.ErrorDescription, "abc123") || !strings.Contains(result.ErrorDescription, "state=xyz") {
+		t.Errorf("code not redacted: %s", result.ErrorDescription)
+	}
+	if !strings.HasSuffix(result.ErrorDescription, `": context deadline exceeded`) {
+		t.Errorf("error text not kept: %s", result.ErrorDescription)
+	}
+}
+
+func TestTimeoutTraceIsRedacted(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := httpClient
+	httpClient = &http.Client{Timeout: 50 * time.Millisecond}
+	defer func() { httpClient = client }()
+
+	request, err := http.NewRequest(http.MethodGet, server.URL+"/cb?code=SECRETCODE&state=xyz", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := defaultTestResult()
+	if _, err = do(request, &result); err == nil {
+		t.Fatal("expected a timeout")
+	}
+	result.failWith(errorRequestFailed, err)
+
+	if len(result.Trace) != 1 || result.Trace[0].Error == "" {
+		t.Fatalf("expected a hop with an error: %+v", result.Trace)
+	}
+	if hopError := result.Trace[0].Error; strings.Contains(hopError, "SECRETCODE") || !strings.Contains(hopError, "code=REDACTED") {
+		t.Errorf("error of hop not redacted: %s", hopError)
+	}
+	status, reason := stepStatus(&result)
+	if status != StepErrored {
+		t.Errorf("unexpected status %s", status)
+	}
+	if strings.Contains(reason, "SECRETCODE") || !strings.HasPrefix(reason, "No response from ") {
+		t.Errorf("unexpected reason: %s", reason)
+	}
+	if strings.Contains(result.ErrorDescription, "SECRETCODE") {
+		t.Errorf("error description not redacted: %s", result.ErrorDescription)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/orangeglasses/cf-uaa-tests/browser"
+)
+
+// Cookie that holds the UAA session.
+const uaaSessionCookie = "JSESSIONID"
+
+// UaaLogout logs out of UAA in a browser session that logged in with UaaAuthorizationCodeAuthentication: it calls the
+// logout endpoint of the client app, which ends the session of the app and redirects to /logout.do of the UAA the
+// session logged in on with the redirect and client_id parameters, and checks that UAA returns to the root page of the
+// app (which must be listed in the redirect_uri of the clients of the app). The UAA session must be invalidated: the
+// session cookie must be removed or replaced, or else no longer be accepted, so a new visit to the client app shows
+// the login form again.
+func UaaLogout(app clientApp, session *browser.Session) TestResult {
+	return logout(app, session, app.url(uaaResourcePath), browser.FormSelector{Fields: []string{"username", "password"}}, false)
+}
+
+// AdfsLogout logs out of UAA in a browser session that logged in with AdfsAuthorizationCodeAuthentication. Besides
+// the checks of UaaLogout, UAA must perform a SAML single logout with ADFS: the session must pass by ADFS with a SAML
+// LogoutRequest and return to the SingleLogout endpoint of UAA, after which ADFS asks for credentials again.
+func AdfsLogout(app clientApp, session *browser.Session) TestResult {
+	return logout(app, session, app.url(adfsResourcePath), browser.FormSelector{Fields: []string{"UserName", "Password"}}, true)
+}
+
+func logout(app clientApp, session *browser.Session, resourceUrl string, loginForm browser.FormSelector, singleLogout bool) (logoutResult TestResult) {
+	logoutResult = defaultTestResult()
+	defer traceSession(session, len(session.Hops), &logoutResult)
+
+	// Find the UAA and client the session logged in with from the authorization request.
+	uaaUrl, clientID, err := authorizationRequest(session)
+	if err != nil {
+		return logoutResult.failAt(nil, "no_uaa_session", err.Error())
+	}
+	sessionCookie, found := cookie(session, uaaUrl, uaaSessionCookie)
+	if !found {
+		return logoutResult.failAt(nil, "no_uaa_session", fmt.Sprintf("No %s cookie for %s", uaaSessionCookie, uaaUrl.String()))
+	}
+
+	firstHop := len(session.Hops)
+	logoutPage, err := session.Get(app.url(appLogoutPath))
+	if err != nil {
+		return logoutResult.failAt(logoutPage, "logout_failed", err.Error())
+	}
+	if !logoutVisited(session.Hops[firstHop:], uaaUrl) {
+		return logoutResult.failAt(logoutPage, "logout_failed", fmt.Sprintf("The client app did not log out of UAA at %s", uaaUrl.String()))
+	}
+	finalUrl := *logoutPage.URL
+	finalUrl.RawQuery = ""
+	finalUrl.Fragment = ""
+	if logoutRedirectUrl := app.url(appRootPath); finalUrl.String() != logoutRedirectUrl {
+		return logoutResult.failAt(logoutPage, "unexpected_logout_redirect", fmt.Sprintf("Expected UAA to return to %s after logout, ended at %s (is it a redirect_uri of client '%s'?)", logoutRedirectUrl, redactURL(logoutPage.URL), clientID))
+	}
+
+	if singleLogout {
+		if err := checkSingleLogout(session.Hops[firstHop:], uaaUrl); err != nil {
+			return logoutResult.failAt(logoutPage, "saml_logout_missing", err.Error())
+		}
+	}
+
+	// The session cookie must be gone, or else no longer be accepted by UAA.
+	newSessionCookie, found := cookie(session, uaaUrl, uaaSessionCookie)
+	cookieReplaced := !found || newSessionCookie.Value != sessionCookie.Value
+	loginPage, err := session.Get(resourceUrl)
+	if err != nil {
+		return logoutResult.failAt(loginPage, "logout_failed", err.Error())
+	}
+	if _, err := loginPage.Form(loginForm); err != nil {
+		description := "Expected the login form after logout, the session is still valid"
+		if !cookieReplaced {
+			description += fmt.Sprintf(" (the %s cookie was not removed)", uaaSessionCookie)
+		}
+		return logoutResult.failAt(loginPage, "session_not_invalidated", description)
+	}
+
+	return logoutResult
+}
+
+// authorizationRequest returns the URL of the UAA (including a context path, if any) that the session was sent to for
+// authorization, and the client the authorization was requested for.
+func authorizationRequest(session *browser.Session) (*url.URL, string, error) {
+	for i := len(session.Hops) - 1; i >= 0; i-- {
+		hopUrl, err := url.Parse(session.Hops[i].URL)
+		if err != nil || !strings.HasSuffix(hopUrl.Path, "/oauth/authorize") {
+			continue
+		}
+		uaaUrl := url.URL{Scheme: hopUrl.Scheme, Host: hopUrl.Host, Path: strings.TrimSuffix(hopUrl.Path, "/oauth/authorize")}
+		return &uaaUrl, hopUrl.Query().Get("client_id"), nil
+	}
+	return nil, "", errors.New("Session did not request authorization at UAA")
+}
+
+// logoutVisited tells whether the hops of a logout include /logout.do of the given UAA.
+func logoutVisited(hops []browser.Hop, uaaUrl *url.URL) bool {
+	for _, hop := range hops {
+		hopUrl, err := url.Parse(hop.URL)
+		if err == nil && hopUrl.Host == uaaUrl.Host && strings.HasSuffix(hopUrl.Path, "/logout.do") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSingleLogout checks that the hops of a logout include a SAML LogoutRequest sent to an identity provider and a
+// return to the SingleLogout endpoint of UAA.
+func checkSingleLogout(hops []browser.Hop, uaaUrl *url.URL) error {
+	logoutRequest := false
+	for _, hop := range hops {
+		hopUrl, err := url.Parse(hop.URL)
+		if err != nil {
+			continue
+		}
+		switch {
+		case hopUrl.Host != uaaUrl.Host && hopUrl.Query().Get("SAMLRequest") != "":
+			logoutRequest = true
+		case logoutRequest && hopUrl.Host == uaaUrl.Host && strings.Contains(hopUrl.Path, "/saml/SingleLogout"):
+			return nil
+		}
+	}
+	if !logoutRequest {
+		return errors.New("UAA did not send a SAML LogoutRequest to the identity provider")
+	}
+	return errors.New("The identity provider did not return to the SingleLogout endpoint of UAA")
+}
+
+func cookie(session *browser.Session, u *url.URL, name string) (*http.Cookie, bool) {
+	for _, c := range session.Cookies(u) {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds (in seconds) of the buckets of the step duration histogram.
+var durationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// stepKey identifies a step of the suite in a zone; its fields are the labels of the step metrics.
+type stepKey struct {
+	service string
+	zone    string
+	step    string
+}
+
+// providerKey identifies an identity provider in a zone; its fields are the labels of the identity provider metrics.
+type providerKey struct {
+	service string
+	zone    string
+	origin  string
+}
+
+// stepMetrics holds the metrics of a step over all runs so far.
+type stepMetrics struct {
+	success  bool
+	warnings int
+	lastRun  time.Time
+	buckets  []uint64
+	count    uint64
+	sum      float64
+	failures map[string]uint64
+}
+
+// metricsRegistry keeps the outcome and duration of every step of every run, and serves them in the Prometheus text
+// exposition format (https://prometheus.io/docs/instrumenting/exposition_formats/).
+type metricsRegistry struct {
+	mutex sync.Mutex
+	steps map[stepKey]*stepMetrics
+
+	// Earliest expiry of the metadata and signing certificates of the SAML providers in the last inventory.
+	providerExpiry map[providerKey]time.Time
+}
+
+var metrics = &metricsRegistry{steps: make(map[stepKey]*stepMetrics), providerExpiry: make(map[providerKey]time.Time)}
+
+func init() {
+	http.Handle("/metrics", metrics)
+}
+
+// record adds the results of a run to the metrics. Steps that did not run (because an earlier step failed) keep the
+// metrics of their last run.
+func (m *metricsRegistry) record(results MultiZoneTestResult) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	for service, zones := range results {
+		for zone, flowsResult := range zones {
+			for step, result := range stepResults(flowsResult) {
+				key := stepKey{service: service, zone: zone, step: step}
+				stepMetrics, exists := m.steps[key]
+				if !exists {
+					stepMetrics = newStepMetrics()
+					m.steps[key] = stepMetrics
+				}
+				stepMetrics.observe(result, now)
+			}
+			if flowsResult.IdentityProviderInventory != nil && flowsResult.IdentityProviderInventory.Status.ran() {
+				m.recordProviders(service, zone, flowsResult.IdentityProviders)
+			}
+		}
+	}
+}
+
+// recordProviders replaces the expiry of the identity providers of a zone by those of its last inventory.
+func (m *metricsRegistry) recordProviders(service, zone string, providers []IdentityProviderInfo) {
+	for key := range m.providerExpiry {
+		if key.service == service && key.zone == zone {
+			delete(m.providerExpiry, key)
+		}
+	}
+	for _, provider := range providers {
+		if expiry := provider.expiry(); !expiry.IsZero() {
+			m.providerExpiry[providerKey{service: service, zone: zone, origin: provider.OriginKey}] = expiry
+		}
+	}
+}
+
+func newStepMetrics() *stepMetrics {
+	return &stepMetrics{buckets: make([]uint64, len(durationBuckets)), failures: make(map[string]uint64)}
+}
+
+func (s *stepMetrics) observe(result *TestResult, at time.Time) {
+	s.success = !result.HasError()
+	s.warnings = len(result.Warnings)
+	s.lastRun = at
+
+	seconds := result.Duration.Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.sum += seconds
+
+	if result.HasError() {
+		errorCode := result.Error
+		if errorCode == "" {
+			errorCode = "unknown"
+		}
+		s.failures[errorCode]++
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	keys := make([]stepKey, 0, len(m.steps))
+	for key := range m.steps {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].service != keys[j].service {
+			return keys[i].service < keys[j].service
+		}
+		if keys[i].zone != keys[j].zone {
+			return keys[i].zone < keys[j].zone
+		}
+		return keys[i].step < keys[j].step
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	writeHeader(w, "uaa_smoke_step_success", "gauge", "Whether the step succeeded in its last run (1) or not (0).")
+	for _, key := range keys {
+		success := 0
+		if m.steps[key].success {
+			success = 1
+		}
+		fmt.Fprintf(w, "uaa_smoke_step_success{%s} %d\n", key.labels(), success)
+	}
+
+	writeHeader(w, "uaa_smoke_step_warnings", "gauge", "Number of warnings of the step in its last run.")
+	for _, key := range keys {
+		fmt.Fprintf(w, "uaa_smoke_step_warnings{%s} %d\n", key.labels(), m.steps[key].warnings)
+	}
+
+	writeHeader(w, "uaa_smoke_step_duration_seconds", "histogram", "Duration of the step.")
+	for _, key := range keys {
+		stepMetrics := m.steps[key]
+		for i, bound := range durationBuckets {
+			fmt.Fprintf(w, "uaa_smoke_step_duration_seconds_bucket{%s,le=\"%g\"} %d\n", key.labels(), bound, stepMetrics.buckets[i])
+		}
+		fmt.Fprintf(w, "uaa_smoke_step_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", key.labels(), stepMetrics.count)
+		fmt.Fprintf(w, "uaa_smoke_step_duration_seconds_sum{%s} %g\n", key.labels(), stepMetrics.sum)
+		fmt.Fprintf(w, "uaa_smoke_step_duration_seconds_count{%s} %d\n", key.labels(), stepMetrics.count)
+	}
+
+	writeHeader(w, "uaa_smoke_step_last_run_timestamp_seconds", "gauge", "Time of the last run of the step.")
+	for _, key := range keys {
+		fmt.Fprintf(w, "uaa_smoke_step_last_run_timestamp_seconds{%s} %d\n", key.labels(), m.steps[key].lastRun.Unix())
+	}
+
+	writeHeader(w, "uaa_smoke_step_failures_total", "counter", "Number of failed runs of the step, by error code.")
+	for _, key := range keys {
+		failures := m.steps[key].failures
+		errorCodes := make([]string, 0, len(failures))
+		for errorCode := range failures {
+			errorCodes = append(errorCodes, errorCode)
+		}
+		sort.Strings(errorCodes)
+		for _, errorCode := range errorCodes {
+			fmt.Fprintf(w, "uaa_smoke_step_failures_total{%s,error=\"%s\"} %d\n", key.labels(), escapeLabelValue(errorCode), failures[errorCode])
+		}
+	}
+
+	providers := make([]providerKey, 0, len(m.providerExpiry))
+	for key := range m.providerExpiry {
+		providers = append(providers, key)
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		if providers[i].service != providers[j].service {
+			return providers[i].service < providers[j].service
+		}
+		if providers[i].zone != providers[j].zone {
+			return providers[i].zone < providers[j].zone
+		}
+		return providers[i].origin < providers[j].origin
+	})
+
+	writeHeader(w, "uaa_smoke_identity_provider_expiry_timestamp_seconds", "gauge", "Earliest expiry of the SAML metadata and signing certificates of the identity provider.")
+	for _, key := range providers {
+		fmt.Fprintf(w, "uaa_smoke_identity_provider_expiry_timestamp_seconds{%s} %d\n", key.labels(), m.providerExpiry[key].Unix())
+	}
+}
+
+func (k stepKey) labels() string {
+	return fmt.Sprintf("service=\"%s\",zone=\"%s\",step=\"%s\"", escapeLabelValue(k.service), escapeLabelValue(k.zone), escapeLabelValue(k.step))
+}
+
+func (k providerKey) labels() string {
+	return fmt.Sprintf("service=\"%s\",zone=\"%s\",origin=\"%s\"", escapeLabelValue(k.service), escapeLabelValue(k.zone), escapeLabelValue(k.origin))
+}
+
+func writeHeader(w io.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+// stepResults returns the results of the steps that ran, by the name of the step in the JSON result. Journeys are
+// named journeys/<name>.
+func stepResults(flowsResult *Oauth2FlowsTestResult) map[string]*TestResult {
+	results := make(map[string]*TestResult)
+	for _, step := range reportSteps(flowsResult) {
+		if step.result.Status.ran() {
+			results[step.name] = step.result
+		}
+	}
+	return results
+}
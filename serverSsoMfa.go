@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/orangeglasses/cf-uaa-tests/browser"
+)
+
+const (
+	// UAA MFA pages (Google Authenticator provider), shown after login when MFA is enabled for the zone. Users that
+	// are not registered yet get the QR code page first, which links to a page with the secret for manual entry.
+	mfaRegisterPath = "/login/mfa/register"
+	mfaManualPath   = "/login/mfa/manual"
+	mfaVerifyPath   = "/login/mfa/verify"
+
+	// Name of the field of the MFA verification form.
+	mfaCodeField = "code"
+
+	// RFC 6238 parameters used by Google Authenticator.
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+)
+
+// Patterns to find the TOTP secret in the registration pages: the otpauth:// URI that the QR code encodes (which may
+// be part of a QR code image URL) or the key shown for manual entry.
+var (
+	otpAuthSecretPattern = regexp.MustCompile(`otpauth(?:://|%3A%2F%2F)totp[^"'\s<>]*?(?:\?|%3F|&amp;|&|%26)secret(?:=|%3D)([A-Za-z2-7]+)`)
+	manualSecretPattern  = regexp.MustCompile(`(?i)(?:key|secret)\s*:?\s*([A-Z2-7]{16,})`)
+)
+
+// mfaCredentials is the TOTP registration of the smoke user. The secret is only kept in memory for the duration of a
+// run; it is removed from UAA together with the user.
+type mfaCredentials struct {
+	secret []byte
+
+	// Answer the verification page with a wrong code, to check that UAA rejects it.
+	invalid bool
+}
+
+// code returns the TOTP code to enter at the given time: a valid code, or a code that is not valid in the current
+// or an adjacent time step when invalid is set.
+func (m *mfaCredentials) code(at time.Time) string {
+	counter := uint64(at.Unix() / int64(totpPeriod.Seconds()))
+	valid := totp(m.secret, counter)
+	if !m.invalid {
+		return valid
+	}
+	candidate := valid
+	for candidate == valid || candidate == totp(m.secret, counter-1) || candidate == totp(m.secret, counter+1) {
+		n, _ := strconv.Atoi(candidate)
+		candidate = fmt.Sprintf("%0*d", totpDigits, (n+1)%1000000)
+	}
+	return candidate
+}
+
+// mfaCode returns a valid MFA code for the password grant, or an empty code when MFA is not enabled.
+func mfaCode(mfa *mfaCredentials) string {
+	if mfa == nil {
+		return ""
+	}
+	return mfa.code(time.Now())
+}
+
+// totp computes the RFC 6238 (HOTP, RFC 4226) code for a time step using HMAC-SHA1.
+func totp(secret []byte, counter uint64) string {
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation.
+	offset := sum[len(sum)-1] & 0x0f
+	binaryCode := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, binaryCode%1000000)
+}
+
+// decodeTotpSecret decodes a base32 TOTP secret as shown by authenticator registration pages: case-insensitive,
+// possibly grouped with spaces and without padding.
+func decodeTotpSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+}
+
+// isMfaPage reports whether the page is the given UAA MFA page.
+func isMfaPage(page *browser.Page, path string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(page.URL.Path, ".do"), path)
+}
+
+// registerMfa takes the TOTP secret from the MFA registration (QR code) page, or else from the manual registration
+// page, and continues to the verification page.
+func registerMfa(session *browser.Session, page *browser.Page) (*mfaCredentials, *browser.Page, error) {
+	secret, found := findTotpSecret(page)
+	if !found {
+		manualPage, err := session.Get(mfaURL(page, mfaManualPath))
+		if err != nil {
+			return nil, nil, err
+		}
+		if secret, found = findTotpSecret(manualPage); !found {
+			return nil, manualPage, errors.New("No TOTP secret found in MFA registration pages")
+		}
+	}
+	key, err := decodeTotpSecret(secret)
+	if err != nil {
+		return nil, page, fmt.Errorf("Invalid TOTP secret: %s", err.Error())
+	}
+
+	verifyPage, err := session.Get(mfaURL(page, mfaVerifyPath))
+	if err != nil {
+		return nil, nil, err
+	}
+	return &mfaCredentials{secret: key}, verifyPage, nil
+}
+
+// verifyMfa enters a TOTP code in the MFA verification page and returns the resulting page. A code that is not
+// accepted results in the verification page being shown again, which is reported as mfa_code_rejected.
+func verifyMfa(session *browser.Session, page *browser.Page, mfa *mfaCredentials) (*browser.Page, error) {
+	form, err := page.Form(browser.FormSelector{Fields: []string{mfaCodeField}})
+	if err != nil {
+		return page, err
+	}
+	form.Set(mfaCodeField, mfa.code(time.Now()))
+	resultPage, err := session.Submit(form)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := resultPage.Form(browser.FormSelector{Fields: []string{mfaCodeField}}); err == nil && isMfaPage(resultPage, mfaVerifyPath) {
+		return resultPage, errMfaCodeRejected
+	}
+	return resultPage, nil
+}
+
+var errMfaCodeRejected = errors.New("UAA did not accept the MFA code")
+
+// RegisterMfa logs in on the UAA login page and registers the user for MFA (Google Authenticator), which UAA requires
+// after the first login when MFA is enabled for the zone. The returned credentials are needed for every later login
+// and password grant of the user. A request that gets no response fails the registration with request_failed.
+func RegisterMfa(username, password, authDomain string) (mfa *mfaCredentials, registerResult TestResult) {
+	registerResult = defaultTestResult()
+	session := browser.NewSession()
+	defer traceSession(session, 0, &registerResult)
+	loginPage, err := session.Get(authDomain + "/login")
+	if err != nil {
+		return nil, registerResult.failAt(loginPage, errorRequestFailed, err.Error())
+	}
+	loginForm, err := loginPage.Form(browser.FormSelector{Fields: []string{"username", "password"}})
+	if err != nil {
+		return nil, registerResult.failAt(loginPage, "login_failed", err.Error())
+	}
+	loginForm.Set("username", username)
+	loginForm.Set("password", password)
+	page, err := session.Submit(loginForm)
+	if err != nil {
+		return nil, registerResult.failAt(page, errorRequestFailed, err.Error())
+	}
+	if !isMfaPage(page, mfaRegisterPath) {
+		return nil, registerResult.failAt(page, "mfa_not_required", "Expected UAA to ask to register for MFA after login, is MFA enabled for the zone?")
+	}
+
+	mfa = &mfaCredentials{}
+	page, err = completeMfa(session, page, mfa)
+	if err == errMfaCodeRejected {
+		return nil, registerResult.failAt(page, "mfa_code_rejected", err.Error())
+	} else if err != nil && page == nil {
+		return nil, registerResult.failAt(nil, errorRequestFailed, err.Error())
+	} else if err != nil {
+		return nil, registerResult.failAt(page, "mfa_registration_failed", err.Error())
+	}
+	return mfa, registerResult
+}
+
+// completeMfa handles the MFA pages that UAA shows after login, if any: it registers the user when needed (filling in
+// mfa) and enters a code in the verification page. Pages other than MFA pages are returned as is.
+func completeMfa(session *browser.Session, page *browser.Page, mfa *mfaCredentials) (*browser.Page, error) {
+	if isMfaPage(page, mfaRegisterPath) {
+		if mfa == nil {
+			return page, errors.New("UAA asks to register for MFA, but MFA is not enabled for the smoke tests (SMOKE_MFA)")
+		}
+		registration, verifyPage, err := registerMfa(session, page)
+		if err != nil {
+			return verifyPage, err
+		}
+		mfa.secret = registration.secret
+		page = verifyPage
+	}
+	if isMfaPage(page, mfaVerifyPath) {
+		if mfa == nil || len(mfa.secret) == 0 {
+			return page, errors.New("UAA asks for an MFA code, but the smoke user has no MFA registration")
+		}
+		return verifyMfa(session, page, mfa)
+	}
+	return page, nil
+}
+
+func findTotpSecret(page *browser.Page) (string, bool) {
+	body := string(page.Body)
+	if match := otpAuthSecretPattern.FindStringSubmatch(body); match != nil {
+		return match[1], true
+	}
+	if match := manualSecretPattern.FindStringSubmatch(page.Text()); match != nil {
+		return match[1], true
+	}
+	return "", false
+}
+
+// mfaURL returns the URL of another MFA page of the same UAA as the given MFA page (which may be served under a
+// context path).
+func mfaURL(page *browser.Page, path string) string {
+	contextPath := page.URL.Path
+	if i := strings.Index(contextPath, "/login/mfa/"); i >= 0 {
+		contextPath = contextPath[:i]
+	}
+	u := url.URL{Scheme: page.URL.Scheme, Host: page.URL.Host, Path: contextPath + path}
+	return u.String()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// The SHA-1 test vectors of RFC 6238 (appendix B), truncated to the 6 digits Google Authenticator uses.
+func TestTotp(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	vectors := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, vector := range vectors {
+		if code := totp(secret, uint64(vector.time/30)); code != vector.code {
+			t.Errorf("totp at %d: got %s, expected %s", vector.time, code, vector.code)
+		}
+	}
+}
+
+func TestMfaCredentialsInvalidCode(t *testing.T) {
+	at := time.Unix(1111111109, 0)
+	valid := &mfaCredentials{secret: []byte("12345678901234567890")}
+	invalid := &mfaCredentials{secret: valid.secret, invalid: true}
+	if code := valid.code(at); code != "081804" {
+		t.Errorf("unexpected valid code %s", code)
+	}
+	code := invalid.code(at)
+	for _, step := range []time.Duration{-totpPeriod, 0, totpPeriod} {
+		if code == valid.code(at.Add(step)) {
+			t.Errorf("invalid code %s is valid at %s", code, at.Add(step))
+		}
+	}
+	if len(code) != totpDigits {
+		t.Errorf("invalid code %s does not have %d digits", code, totpDigits)
+	}
+}
+
+func TestDecodeTotpSecret(t *testing.T) {
+	// "12345678901234567890" in base32, grouped and in lower case as some registration pages show it.
+	secret, err := decodeTotpSecret("gezd gnbv gy3t qojq gezd gnbv gy3t qojq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret) != "12345678901234567890" {
+		t.Errorf("unexpected secret %q", secret)
+	}
+}
+
+// A login that gets no response is a failed request rather than a failed login.
+func TestRegisterMfaErrors(t *testing.T) {
+	var loginPage string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			panic(http.ErrAbortHandler)
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(loginPage))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		loginPage  string
+		authDomain string
+		error      string
+	}{
+		{"no login page", "", "http://127.0.0.1:1", errorRequestFailed},
+		{"no login form", "<html><body>Maintenance</body></html>", server.URL, "login_failed"},
+		{"no response to the login", `<html><body><form method="post" action="/login.do">
+			<input name="username"><input type="password" name="password"></form></body></html>`, server.URL, errorRequestFailed},
+	}
+	for _, test := range tests {
+		loginPage = test.loginPage
+		if _, result := RegisterMfa("smokeuser-test", "secret", test.authDomain); result.Error != test.error {
+			t.Errorf("%s: unexpected result %+v", test.name, result)
+		}
+	}
+}
@@ -1,25 +1,20 @@
 package main
 
 import (
-	"net/http/cookiejar"
 	"net/http"
 	"bytes"
 	"encoding/json"
 	"strings"
 	"net/url"
 	"fmt"
-	"golang.org/x/oauth2"
-	"golang.org/x/net/html"
-	"io"
-	"errors"
+	"time"
+
+	"github.com/orangeglasses/cf-uaa-tests/browser"
 )
 
 const (
 	clientCredentialsGrantType = "client_credentials"
 	passwordGrantType          = "password"
-
-	uaaResourceUrl = "http://smoketests-resource.cf-tst.intranet.rws.nl/uaaLogin"
-	adfsResourceUrl = "http://smoketests-resource.cf-tst.intranet.rws.nl/adfsLogin"
 )
 
 // ClientCredentialsAuthentication performs the OAuth2 client credentials flow against UAA and returns the
@@ -36,42 +31,47 @@ func ClientCredentialsAuthentication(clientID, clientSecret, authDomain string)
 
 	clientCredentialsGrantRequest, err := http.NewRequest(http.MethodPost, authDomain+"/oauth/token", strings.NewReader(clientCredentialsForm.Encode()))
 	if err != nil {
-		panic(err)
+		authResult.failWith(errorRequestFailed, err)
+		return TokenResponse{}, authResult
 	}
 	clientCredentialsGrantRequest.Header.Add("Accept", "application/json")
 	clientCredentialsGrantRequest.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
 	// Execute request.
-	httpClient := &http.Client{}
-	clientCredentialsGrantResponse, err := httpClient.Do(clientCredentialsGrantRequest)
+	requestedAt := time.Now()
+	clientCredentialsGrantResponse, err := do(clientCredentialsGrantRequest, &authResult)
 	if err != nil {
-		panic(err)
+		authResult.failWith(errorRequestFailed, err)
+		return TokenResponse{}, authResult
 	}
 	defer clientCredentialsGrantResponse.Body.Close()
 
-	// Parse token response.
+	// Check response status code.
 	responseBuffer := new(bytes.Buffer)
 	responseBuffer.ReadFrom(clientCredentialsGrantResponse.Body)
-	var tokenResponse TokenResponse
-	err = json.Unmarshal(responseBuffer.Bytes(), &tokenResponse)
-	if err != nil {
-		panic(err)
-	}
-
-	// Check response status code.
 	statusCode := clientCredentialsGrantResponse.StatusCode
 	if statusCode != http.StatusOK {
 		authResult.Result = false
 		authResult.StatusCode = &statusCode
 		authResult.ParseErrorResponse(responseBuffer)
+		return TokenResponse{}, authResult
 	}
 
+	// Parse token response.
+	var tokenResponse TokenResponse
+	if err = json.Unmarshal(responseBuffer.Bytes(), &tokenResponse); err != nil {
+		authResult.StatusCode = &statusCode
+		authResult.failWith(errorInvalidResponse, err)
+		return TokenResponse{}, authResult
+	}
+	tokenResponse.setExpiry(requestedAt)
+
 	return tokenResponse, authResult
 }
 
 // PasswordAuthentication performs the OAuth2 password credentials flow against UAA and returns the
-// JWT token and test result.
-func PasswordAuthentication(clientID, clientSecret, authDomain, username, password string) (TokenResponse, TestResult) {
+// JWT token and test result. When MFA is enabled for the zone, an MFA code must be passed as well.
+func PasswordAuthentication(clientID, clientSecret, authDomain, username, password, mfaCode string) (TokenResponse, TestResult) {
 	authResult := defaultTestResult()
 
 	// Construct OAuth2 password grant request.
@@ -82,32 +82,30 @@ func PasswordAuthentication(clientID, clientSecret, authDomain, username, passwo
 	passwordGrantForm.Set("response_type", "token")
 	passwordGrantForm.Set("username", username)
 	passwordGrantForm.Set("password", password)
+	if mfaCode != "" {
+		passwordGrantForm.Set("mfaCode", mfaCode)
+	}
 
 	passwordGrantRequest, err := http.NewRequest(http.MethodPost, authDomain+"/oauth/token", strings.NewReader(passwordGrantForm.Encode()))
 	if err != nil {
-		panic(err)
+		authResult.failWith(errorRequestFailed, err)
+		return TokenResponse{}, authResult
 	}
 	passwordGrantRequest.Header.Add("Accept", "application/json")
 	passwordGrantRequest.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
 	// Execute request.
-	httpClient := &http.Client{}
-	passwordGrantResponse, err := httpClient.Do(passwordGrantRequest)
+	requestedAt := time.Now()
+	passwordGrantResponse, err := do(passwordGrantRequest, &authResult)
 	if err != nil {
-		panic(err)
+		authResult.failWith(errorRequestFailed, err)
+		return TokenResponse{}, authResult
 	}
 	defer passwordGrantResponse.Body.Close()
 
-	// Parse token response.
+	// Check response status code.
 	responseBuffer := new(bytes.Buffer)
 	responseBuffer.ReadFrom(passwordGrantResponse.Body)
-	var tokenResponse TokenResponse
-	err = json.Unmarshal(responseBuffer.Bytes(), &tokenResponse)
-	if err != nil {
-		panic(err)
-	}
-
-	// Check response status code.
 	statusCode := passwordGrantResponse.StatusCode
 	if statusCode != http.StatusOK {
 		authResult.Result = false
@@ -115,291 +113,169 @@ func PasswordAuthentication(clientID, clientSecret, authDomain, username, passwo
 
 		// Try parse error response.
 		authResult.ParseErrorResponse(responseBuffer)
-	}
-
-	return tokenResponse, authResult
-}
-
-func UaaAuthorizationCodeAuthentication(uaaSmokeUsername, uaaSmokePassword string) (TokenResponse, TestResult) {
-	authResult := defaultTestResult()
-
-	// Create http client with cookie jar (otherwise cookies are ignored).
-	cookieJar, _ := cookiejar.New(nil)
-	httpClient := http.Client{Jar: cookieJar}
-
-	// Attempt to access resource that is protected by UAA client application.
-	resp, err := httpClient.Get(uaaResourceUrl)
-	if err != nil {
-		authResult.Result = false
-		authResult.Error = err.Error()
-		return TokenResponse{}, authResult
-	}
-	defer resp.Body.Close()
-
-	// Construct authorization base url from response.
-	authBaseUrl := fmt.Sprintf("%s://%s", resp.Request.URL.Scheme, resp.Request.URL.Host)
-
-	// Locate form element and input fields in response body to simulate login.
-	form, fields, err := getFormDetails(resp.Body)
-	if err != nil {
-		authResult.Result = false
-		authResult.Error = err.Error()
 		return TokenResponse{}, authResult
 	}
 
-	// Enter username and password.
-	for i, v := range fields {
-		if v.name == "username" {
-			fields[i].value = uaaSmokeUsername
-		}
-		if v.name == "password" {
-			fields[i].value = uaaSmokePassword
-		}
-	}
-
-	// Construct login request.
-	authUrl := fmt.Sprintf("%s%s", authBaseUrl, form.action)
-	loginForm := url.Values{}
-	for _, f := range fields {
-		loginForm.Set(f.name, f.value)
-	}
-	authRequest, err := http.NewRequest(strings.ToUpper(form.method), authUrl, strings.NewReader(loginForm.Encode()))
-	if err != nil {
-		panic(err)
-	}
-	authRequest.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-	// Perform login.
-	authResponse, err := httpClient.Do(authRequest)
-	if err != nil {
-		authResult.Result = false
-		authResult.Error = err.Error()
-		return TokenResponse{}, authResult
-	}
-	defer authResponse.Body.Close()
-
-	// Parse response.
-	statusCode := authResponse.StatusCode
-	responseBuffer := new(bytes.Buffer)
-	responseBuffer.ReadFrom(authResponse.Body)
-	if statusCode == http.StatusBadRequest {
-		// Parse error response.
-		var authError authError
-		_ = json.Unmarshal(responseBuffer.Bytes(), &authError)
-
-		authResult.Result = false
+	// Parse token response.
+	var tokenResponse TokenResponse
+	if err = json.Unmarshal(responseBuffer.Bytes(), &tokenResponse); err != nil {
 		authResult.StatusCode = &statusCode
-		authResult.Error = authError.Error
-		authResult.ErrorDescription = authError.ErrorDescription
+		authResult.failWith(errorInvalidResponse, err)
 		return TokenResponse{}, authResult
 	}
+	tokenResponse.setExpiry(requestedAt)
 
-	// We received back the token.
-	var token oauth2.Token
-	_ = json.Unmarshal(responseBuffer.Bytes(), &token)
-
-	return TokenResponse{AccessToken: token.AccessToken, TokenType: token.TokenType, RefreshToken: token.RefreshToken, ExpiresIn: int(token.Expiry.Unix())}, authResult
+	return tokenResponse, authResult
 }
 
-func AdfsAuthorizationCodeAuthentication(adfsSmokeUsername, adfsSmokePassword string) (TokenResponse, TestResult) {
-	authResult := defaultTestResult()
-
-	// Create http client with cookie jar (otherwise cookies are ignored).
-	cookieJar, _ := cookiejar.New(nil)
-	httpClient := http.Client{Jar: cookieJar}
+// UaaAuthorizationCodeAuthentication performs the OAuth2 authorization code flow by emulating a browser that accesses
+// the UAA protected endpoint of the given client app and logs in on the UAA login page, in the given browser session.
+// When UAA asks for an MFA code, it is computed from the given MFA credentials (nil when MFA is not enabled). When UAA
+// asks the user to approve the requested scopes, the approval page is answered with the given decision.
+func UaaAuthorizationCodeAuthentication(app clientApp, session *browser.Session, uaaSmokeUsername, uaaSmokePassword string, mfa *mfaCredentials, consent consentDecision) (tokenResponse TokenResponse, authResult TestResult) {
+	authResult = defaultTestResult()
+	defer traceSession(session, len(session.Hops), &authResult)
 
-	// Attempt to access resource that is protected by UAA client application.
-	resp, err := httpClient.Get(adfsResourceUrl)
+	// Attempt to access resource that is protected by UAA client application, this redirects to the UAA login page.
+	loginPage, err := session.Get(app.url(uaaResourcePath))
 	if err != nil {
-		authResult.Result = false
-		authResult.Error = err.Error()
+		authResult.failWith(errorRequestFailed, err)
 		return TokenResponse{}, authResult
 	}
-	defer resp.Body.Close()
-
-	// Construct authorization base url from response (federatie.rws.nl).
-	authBaseUrl := fmt.Sprintf("%s://%s", resp.Request.URL.Scheme, resp.Request.URL.Host)
 
-	// We receive a redirect to an ADFS login form: parse the form to be able to POST it back.
-	loginForm, loginFields, err := getFormDetails(resp.Body)
-	for i, v := range loginFields {
-		if v.name == "UserName" {
-			loginFields[i].value = adfsSmokeUsername
-		}
-		if v.name == "Password" {
-			loginFields[i].value = adfsSmokePassword
-		}
-	}
-	authUrl := fmt.Sprintf("%s%s", authBaseUrl, loginForm.action)
-
-	// Compose login form.
-	loginFormValues := url.Values{}
-	for _, f := range loginFields {
-		loginFormValues.Set(f.name, f.value)
-	}
-
-	// Compose login request.
-	loginRequest, err := http.NewRequest(strings.ToUpper(loginForm.method), authUrl, strings.NewReader(loginFormValues.Encode()))
+	// Locate the login form, enter username and password and perform login. The form action is resolved against the
+	// URL of the login page (after following redirects, so behind reverse proxies as well) and <base href>.
+	callbackPage, err := session.Fill(loginPage, browser.FormSelector{Fields: []string{"username", "password"}}, map[string]string{
+		"username": uaaSmokeUsername,
+		"password": uaaSmokePassword,
+	})
 	if err != nil {
-		authResult.Result = false
-		authResult.Error = err.Error()
+		authResult.failWith("login_failed", err)
 		return TokenResponse{}, authResult
 	}
-	loginRequest.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	// Perform login request.
-	loginResponse, err := httpClient.Do(loginRequest)
-	if err != nil {
+	// When MFA is enabled for the zone, UAA asks for a code after login.
+	callbackPage, err = completeMfa(session, callbackPage, mfa)
+	if err == errMfaCodeRejected {
 		authResult.Result = false
-		authResult.Error = err.Error()
+		authResult.Error = "mfa_code_rejected"
+		authResult.ErrorDescription = err.Error()
+		return TokenResponse{}, authResult
+	} else if err != nil {
+		authResult.failWith("mfa_failed", err)
 		return TokenResponse{}, authResult
 	}
-	defer loginResponse.Body.Close()
-
-	// The result of the login is another form that allows us to go back to rws.login.cf-prod.intranet.rws.nl.
-	samlForm, samlFields, err := getFormDetails(loginResponse.Body)
 
-	// Compose SAML form.
-	samlFormValues := url.Values{}
-	for _, f := range samlFields {
-		samlFormValues.Set(f.name, f.value)
+	// For clients that are not autoapprove, UAA shows a scope approval page after login.
+	if form, found := approvalForm(callbackPage); found {
+		callbackPage, err = answerConsent(session, form, consent)
+		if err != nil {
+			authResult.failWith("consent_failed", err)
+			return TokenResponse{}, authResult
+		}
 	}
 
-	// Compose SAML request.
-	samlAuthRequest, err := http.NewRequest(strings.ToUpper(samlForm.method), samlForm.action, strings.NewReader(samlFormValues.Encode()))
-	if err != nil {
-		authResult.Result = false
-		authResult.Error = err.Error()
-		return TokenResponse{}, authResult
-	}
-	samlAuthRequest.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	return parseCallbackResponse(callbackPage, app.url(uaaCallbackPath), authResult)
+}
+
+// AdfsAuthorizationCodeAuthentication performs the OAuth2 authorization code flow by emulating a browser that accesses
+// the ADFS protected endpoint of the given client app and logs in on the ADFS login page, in the given browser session.
+func AdfsAuthorizationCodeAuthentication(app clientApp, session *browser.Session, adfsSmokeUsername, adfsSmokePassword string) (tokenResponse TokenResponse, authResult TestResult) {
+	authResult = defaultTestResult()
+	defer traceSession(session, len(session.Hops), &authResult)
 
-	// Perform SAML request.
-	samlAuthResponse, err := httpClient.Do(samlAuthRequest)
+	// Attempt to access resource that is protected by UAA client application, this redirects (via UAA) to an ADFS
+	// login form (federatie.rws.nl).
+	loginPage, err := session.Get(app.url(adfsResourcePath))
 	if err != nil {
-		authResult.Result = false
-		authResult.Error = err.Error()
+		authResult.failWith(errorRequestFailed, err)
 		return TokenResponse{}, authResult
 	}
-	defer samlAuthResponse.Body.Close()
-
-	// Parse response.
-	statusCode := samlAuthResponse.StatusCode
-	responseBuffer := new(bytes.Buffer)
-	responseBuffer.ReadFrom(samlAuthResponse.Body)
-	if statusCode == http.StatusBadRequest {
-		// Parse error response.
-		var authError authError
-		_ = json.Unmarshal(responseBuffer.Bytes(), &authError)
 
-		authResult.Result = false
-		authResult.StatusCode = &statusCode
-		authResult.Error = authError.Error
-		authResult.ErrorDescription = authError.ErrorDescription
+	// Perform login. The result of the login is an auto-post SAML form that takes us back to UAA
+	// (rws.login.cf-prod.intranet.rws.nl), which is followed by the session, and from there to the client app.
+	callbackPage, err := session.Fill(loginPage, browser.FormSelector{Fields: []string{"UserName", "Password"}}, map[string]string{
+		"UserName": adfsSmokeUsername,
+		"Password": adfsSmokePassword,
+	})
+	if err != nil {
+		authResult.failWith("login_failed", err)
 		return TokenResponse{}, authResult
 	}
 
-	// We received back the token.
-	var token oauth2.Token
-	_ = json.Unmarshal(responseBuffer.Bytes(), &token)
-
-	return TokenResponse{AccessToken: token.AccessToken, TokenType: token.TokenType, RefreshToken: token.RefreshToken, ExpiresIn: int(token.Expiry.Unix())}, authResult
+	return parseCallbackResponse(callbackPage, app.url(adfsCallbackPath), authResult)
 }
 
-func getFormDetails(doc io.Reader) (formInfo, []fieldInfo, error) {
-	// Parse html document that contains our login form.
-	root, err := html.Parse(doc)
-	if err != nil {
-		return formInfo{}, nil, err
-	}
-
-	// Find form html node.
-	formNode := findForm(root)
-	if formNode == nil {
-		return formInfo{}, nil, errors.New("No form found in UAA login form")
+// parseCallbackResponse checks that a browser journey ended at the callback endpoint of the client app with a token.
+// The final page must be the callback URL and return 200 with a JSON body that contains an access token. Anything
+// else fails the test, recording the status, final URL and an excerpt of the body.
+func parseCallbackResponse(callbackPage *browser.Page, callbackUrl string, authResult TestResult) (TokenResponse, TestResult) {
+	statusCode := callbackPage.StatusCode
+
+	finalUrl := *callbackPage.URL
+	finalUrl.RawQuery = ""
+	finalUrl.Fragment = ""
+	if finalUrl.String() != callbackUrl {
+		return TokenResponse{}, authResult.failAt(callbackPage, "unexpected_final_url", fmt.Sprintf("Expected to end at %s, ended at %s", callbackUrl, finalUrl.String()))
 	}
 
-	// Get relevant attributes from form.
-	var form formInfo
-	for _, att := range formNode.Attr {
-		if att.Key == "action" {
-			form.action = att.Val
+	if statusCode != http.StatusOK {
+		// Parse error response.
+		var authError authError
+		if err := json.Unmarshal(callbackPage.Body, &authError); err != nil || authError.Error == "" {
+			return TokenResponse{}, authResult.failAt(callbackPage, "unexpected_status", fmt.Sprintf("Callback returned status %d", statusCode))
 		}
-		if att.Key == "method" {
-			form.method = att.Val
+		if !callbackErrors[authError.Error] {
+			description := authError.Error
+			if authError.ErrorDescription != "" {
+				description += ": " + authError.ErrorDescription
+			}
+			return TokenResponse{}, authResult.failAt(callbackPage, errorCallbackFailed, description)
 		}
+		return TokenResponse{}, authResult.failAt(callbackPage, authError.Error, authError.ErrorDescription)
 	}
 
-	// Get fields inside form.
-	fields := findInputs(formNode)
-
-	// Filter out submit button.
-	for i, v := range fields {
-		if v.fieldType == "submit" {
-			fields = append(fields[:i], fields[i+1:]...)
-		}
+	if contentType := callbackPage.ContentType(); contentType != "application/json" {
+		return TokenResponse{}, authResult.failAt(callbackPage, "unexpected_content_type", fmt.Sprintf("Expected application/json from callback, got '%s'", contentType))
 	}
 
-	return form, fields, nil
-}
-
-func findForm(root *html.Node) *html.Node {
-	var formFinder func(*html.Node) *html.Node
-	formFinder = func(n *html.Node) (form *html.Node) {
-		if n.Type == html.ElementNode && n.Data == "form" {
-			form = n
-			return
-		}
-		for c := n.FirstChild; c != nil && form == nil; c = c.NextSibling {
-			form = formFinder(c)
-		}
-		return
+	// We received back the token response as returned by UAA. The token was issued just before the last hop.
+	var token TokenResponse
+	if err := json.Unmarshal(callbackPage.Body, &token); err != nil {
+		return TokenResponse{}, authResult.failAt(callbackPage, "invalid_token_response", err.Error())
 	}
-	return formFinder(root)
-}
-
-func findInputs(formNode *html.Node) []fieldInfo {
-	var fields []fieldInfo
-
-	var inputFinder func(*html.Node)
-	inputFinder = func(n *html.Node) {
-		// Find input attributes inside form: name and value.
-		if n.Type == html.ElementNode && n.Data == "input" {
-			var field fieldInfo
-			for _, att := range n.Attr {
-				if att.Key == "name" {
-					field.name = att.Val
-				}
-				if att.Key == "value" {
-					field.value = att.Val
-				}
-				if att.Key == "type" {
-					field.fieldType = att.Val
-				}
-			}
-			fields = append(fields, field)
-		}
-		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			inputFinder(c)
-		}
+	if token.AccessToken == "" {
+		return TokenResponse{}, authResult.failAt(callbackPage, "missing_access_token", "Callback response does not contain an access_token")
 	}
-	inputFinder(formNode)
-	return fields
-}
+	token.setExpiry(callbackPage.RequestedAt)
 
-type formInfo struct {
-	method string
-	action string
+	return token, authResult
 }
 
-type fieldInfo struct {
-	fieldType string
-	name      string
-	value     string
+// Errors the callback of the client app returns: those of the authorization response (OAuth2 and OpenID Connect) and
+// its own. Any other error is reported as errorCallbackFailed, as the error of a result labels metrics and alerts.
+var callbackErrors = map[string]bool{
+	"invalid_request":            true,
+	"unauthorized_client":        true,
+	"access_denied":              true,
+	"unsupported_response_type":  true,
+	"invalid_scope":              true,
+	"server_error":               true,
+	"temporarily_unavailable":    true,
+	"interaction_required":       true,
+	"login_required":             true,
+	"account_selection_required": true,
+	"consent_required":           true,
+	"missing_state":              true,
+	"invalid_state":              true,
+	"missing_code":               true,
+	"token_exchange_failed":      true,
 }
 
+const errorCallbackFailed = "callback_failed"
+
 type authError struct {
-	Error            string `json:error,omitempty`
-	ErrorDescription string `json:error_description,omitempty`
+	Error            string `json:"error,omitempty"`
+	ErrorDescription string `json:"error_description,omitempty"`
 }
 
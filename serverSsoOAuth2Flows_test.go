@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/orangeglasses/cf-uaa-tests/browser"
+)
+
+func TestParseCallbackResponseErrors(t *testing.T) {
+	tests := []struct {
+		body        string
+		error       string
+		description string
+	}{
+		{`{"error":"access_denied","error_description":"User denied access"}`, "access_denied", "User denied access"},
+		{`{"error":"token_exchange_failed","error_description":"oauth2: cannot fetch token: 401 Unauthorized"}`, "token_exchange_failed", "oauth2: cannot fetch token: 401 Unauthorized"},
+		{`{"error":"oauth2: cannot fetch token: 401 Unauthorized\nResponse: {}"}`, errorCallbackFailed, "oauth2: cannot fetch token: 401 Unauthorized\nResponse: {}"},
+		{`{"error":"Invalid oauth2 state","error_description":"expected 'a'"}`, errorCallbackFailed, "Invalid oauth2 state: expected 'a'"},
+		{`not json`, "unexpected_status", "Callback returned status 400"},
+	}
+	callbackURL, _ := url.Parse(defaultClientApp.url(uaaCallbackPath) + "?state=xyz")
+	for _, test := range tests {
+		page := &browser.Page{URL: callbackURL, StatusCode: http.StatusBadRequest, Header: http.Header{}, Body: []byte(test.body)}
+		_, result := parseCallbackResponse(page, defaultClientApp.url(uaaCallbackPath), defaultTestResult())
+		if result.Error != test.error || result.ErrorDescription != test.description {
+			t.Errorf("%s: got %q (%q), expected %q (%q)", test.body, result.Error, result.ErrorDescription, test.error, test.description)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+)
+
+const (
+	lowerCaseCharacters = "abcdefghijklmnopqrstuvwxyz"
+	upperCaseCharacters = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	digitCharacters     = "0123456789"
+	specialCharacters   = "!#$%&()*+,-./:;<=>?@[]^_{|}~"
+
+	// Length used for generated passwords when the policy allows it.
+	preferredPasswordLength = 24
+)
+
+// PasswordPolicy mirrors the passwordPolicy section of the UAA identity provider configuration.
+// https://docs.cloudfoundry.org/api/uaa/version/4.7.0/index.html#create-2
+type PasswordPolicy struct {
+	MinLength                 int  `json:"minLength"`
+	MaxLength                 int  `json:"maxLength"`
+	RequireUpperCaseCharacter int  `json:"requireUpperCaseCharacter"`
+	RequireLowerCaseCharacter int  `json:"requireLowerCaseCharacter"`
+	RequireDigit              int  `json:"requireDigit"`
+	RequireSpecialCharacter   int  `json:"requireSpecialCharacter"`
+	ExpirePasswordInMonths    int  `json:"expirePasswordInMonths"`
+	PasswordNewerThan         *int `json:"passwordNewerThan,omitempty"`
+}
+
+type uaaIdentityProviderConfig struct {
+	PasswordPolicy *PasswordPolicy `json:"passwordPolicy"`
+}
+
+// defaultPasswordPolicy is used when the zone password policy cannot be read. It requires every character class
+// so the generated password is accepted by any reasonable policy.
+func defaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:                 preferredPasswordLength,
+		MaxLength:                 255,
+		RequireUpperCaseCharacter: 1,
+		RequireLowerCaseCharacter: 1,
+		RequireDigit:              1,
+		RequireSpecialCharacter:   1,
+	}
+}
+
+// GetPasswordPolicy reads the password policy that applies to internal (origin 'uaa') users. It first tries the
+// /passwordPolicy endpoint and falls back to the configuration of the 'uaa' identity provider, which requires the
+// idps.read authority. The requests are recorded in the trace of the given result.
+func GetPasswordPolicy(tokens *TokenSource, authDomain string, zone IdentityZone, result *TestResult) (PasswordPolicy, error) {
+	var policy PasswordPolicy
+	responseBuffer, err := getWithToken(authDomain+"/passwordPolicy", tokens, zone, result)
+	if err == nil {
+		if err = json.Unmarshal(responseBuffer.Bytes(), &policy); err == nil {
+			return policy, nil
+		}
+	}
+
+	providers, err := getIdentityProviders(tokens, authDomain, zone, result)
+	if err != nil {
+		return PasswordPolicy{}, err
+	}
+	for _, provider := range providers {
+		if provider.OriginKey != "uaa" {
+			continue
+		}
+		var config uaaIdentityProviderConfig
+		if err = json.Unmarshal([]byte(provider.Config), &config); err != nil {
+			return PasswordPolicy{}, err
+		}
+		if config.PasswordPolicy == nil {
+			return PasswordPolicy{}, errors.New("No password policy configured for identity provider 'uaa'")
+		}
+		return *config.PasswordPolicy, nil
+	}
+	return PasswordPolicy{}, errors.New("No identity provider with origin 'uaa' found")
+}
+
+// requiredCharacters returns the number of characters the policy requires of all classes together.
+func (policy PasswordPolicy) requiredCharacters() int {
+	return policy.RequireUpperCaseCharacter + policy.RequireLowerCaseCharacter + policy.RequireDigit + policy.RequireSpecialCharacter
+}
+
+// validate checks that a password can satisfy the policy.
+func (policy PasswordPolicy) validate() error {
+	if policy.MaxLength > 0 && policy.MinLength > policy.MaxLength {
+		return fmt.Errorf("Password policy requires at least %d characters, but allows at most %d", policy.MinLength, policy.MaxLength)
+	}
+	if required := policy.requiredCharacters(); policy.MaxLength > 0 && required > policy.MaxLength {
+		return fmt.Errorf("Password policy requires %d characters of specific classes, but allows at most %d characters", required, policy.MaxLength)
+	}
+	return nil
+}
+
+// GeneratePassword returns a random password that satisfies the given policy, which must be valid (see validate).
+func GeneratePassword(policy PasswordPolicy) string {
+	length := preferredPasswordLength
+	if policy.MinLength > length {
+		length = policy.MinLength
+	}
+	if policy.MaxLength > 0 && policy.MaxLength < length {
+		length = policy.MaxLength
+	}
+
+	// Start with the required number of characters of each class, then fill up with characters of all classes.
+	var password []byte
+	password = append(password, randomCharacters(upperCaseCharacters, policy.RequireUpperCaseCharacter)...)
+	password = append(password, randomCharacters(lowerCaseCharacters, policy.RequireLowerCaseCharacter)...)
+	password = append(password, randomCharacters(digitCharacters, policy.RequireDigit)...)
+	password = append(password, randomCharacters(specialCharacters, policy.RequireSpecialCharacter)...)
+	if remaining := length - len(password); remaining > 0 {
+		password = append(password, randomCharacters(lowerCaseCharacters+upperCaseCharacters+digitCharacters+specialCharacters, remaining)...)
+	}
+
+	// Shuffle so the required characters are not always at the start (Fisher-Yates).
+	for i := len(password) - 1; i > 0; i-- {
+		j := randomInt(i + 1)
+		password[i], password[j] = password[j], password[i]
+	}
+	return string(password)
+}
+
+func randomCharacters(alphabet string, count int) []byte {
+	characters := make([]byte, count)
+	for i := range characters {
+		characters[i] = alphabet[randomInt(len(alphabet))]
+	}
+	return characters
+}
+
+func randomInt(max int) int {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		panic(err)
+	}
+	return int(n.Int64())
+}
+
+// getWithToken gets a JSON resource from UAA, recording the request in the trace of the result (when not nil).
+func getWithToken(url string, tokens *TokenSource, zone IdentityZone, result *TestResult) (*bytes.Buffer, error) {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Add("Accept", "application/json")
+	zone.addHeaders(request)
+
+	response, err := doWithToken(request, tokens, result)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	responseBuffer := new(bytes.Buffer)
+	responseBuffer.ReadFrom(response.Body)
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned status %d", url, response.StatusCode)
+	}
+	return responseBuffer, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGeneratePassword(t *testing.T) {
+	policies := []struct {
+		name   string
+		policy PasswordPolicy
+	}{
+		{"default", defaultPasswordPolicy()},
+		{"no requirements", PasswordPolicy{}},
+		{"short maximum", PasswordPolicy{MinLength: 8, MaxLength: 10, RequireUpperCaseCharacter: 2, RequireDigit: 2}},
+		{"long minimum", PasswordPolicy{MinLength: 40, MaxLength: 64, RequireSpecialCharacter: 3}},
+		{"requirements fill the maximum", PasswordPolicy{MaxLength: 8, RequireUpperCaseCharacter: 2, RequireLowerCaseCharacter: 2, RequireDigit: 2, RequireSpecialCharacter: 2}},
+		{"requirements beyond the preferred length", PasswordPolicy{RequireDigit: 20, RequireSpecialCharacter: 10}},
+	}
+	for _, test := range policies {
+		t.Run(test.name, func(t *testing.T) {
+			policy := test.policy
+			if err := policy.validate(); err != nil {
+				t.Fatal(err)
+			}
+			password := GeneratePassword(policy)
+			if len(password) < policy.MinLength || policy.MaxLength > 0 && len(password) > policy.MaxLength {
+				t.Errorf("length %d outside %d-%d: %s", len(password), policy.MinLength, policy.MaxLength, password)
+			}
+			counts := []struct {
+				class    string
+				alphabet string
+				required int
+			}{
+				{"upper case", upperCaseCharacters, policy.RequireUpperCaseCharacter},
+				{"lower case", lowerCaseCharacters, policy.RequireLowerCaseCharacter},
+				{"digit", digitCharacters, policy.RequireDigit},
+				{"special", specialCharacters, policy.RequireSpecialCharacter},
+			}
+			for _, count := range counts {
+				n := 0
+				for _, c := range password {
+					if strings.ContainsRune(count.alphabet, c) {
+						n++
+					}
+				}
+				if n < count.required {
+					t.Errorf("%d %s characters, %d required: %s", n, count.class, count.required, password)
+				}
+			}
+		})
+	}
+}
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	invalid := []PasswordPolicy{
+		{MinLength: 12, MaxLength: 8},
+		{MaxLength: 6, RequireUpperCaseCharacter: 2, RequireLowerCaseCharacter: 2, RequireDigit: 2, RequireSpecialCharacter: 1},
+	}
+	for _, policy := range invalid {
+		if err := policy.validate(); err == nil {
+			t.Errorf("expected an error for %+v", policy)
+		}
+	}
+}
+
+// Without the /passwordPolicy endpoint, the policy is read from the 'uaa' identity provider; both requests are traced.
+func TestGetPasswordPolicyFromIdentityProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path != "/identity-providers" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`[{"originKey":"uaa","type":"uaa","config":"{\"passwordPolicy\":{\"minLength\":12,\"requireDigit\":2}}"}]`))
+	}))
+	defer server.Close()
+	tokens := NewTokenSource("admin", "secret", server.URL)
+	tokens.set(TokenResponse{AccessToken: "token"})
+
+	result := defaultTestResult()
+	policy, err := GetPasswordPolicy(tokens, server.URL, IdentityZone{}, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.MinLength != 12 || policy.RequireDigit != 2 {
+		t.Errorf("unexpected policy %+v", policy)
+	}
+	if len(result.Trace) != 2 || result.Trace[0].StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected trace %+v", result.Trace)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Report formats of the results of a run.
+const (
+	reportJSON  = "json"
+	reportJUnit = "junit"
+	reportTAP   = "tap"
+	reportTable = "table"
+)
+
+var reportContentTypes = map[string]string{
+	reportJSON:  "application/json",
+	reportJUnit: "application/xml",
+	reportTAP:   "text/x-tap; charset=utf-8",
+	reportTable: "text/plain; charset=utf-8",
+}
+
+// reportMediaTypes maps the media types of an Accept header to report formats.
+var reportMediaTypes = map[string]string{
+	"application/json":      reportJSON,
+	"application/*":         reportJSON,
+	"*/*":                   reportJSON,
+	"application/xml":       reportJUnit,
+	"application/junit+xml": reportJUnit,
+	"text/xml":              reportJUnit,
+	"text/x-tap":            reportTAP,
+	"text/plain":            reportTable,
+	"text/*":                reportTable,
+}
+
+// reportFormat returns the report format requested by the format query parameter (json, junit, tap or table) or, in
+// its absence, by the Accept header. It returns false when no supported format was requested.
+func reportFormat(r *http.Request) (string, bool) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		_, supported := reportContentTypes[format]
+		return format, supported
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return reportJSON, true
+	}
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+		if format, exists := reportMediaTypes[mediaType]; exists {
+			return format, true
+		}
+	}
+	return "", false
+}
+
+// reportStep is a step of a run in a report.
+type reportStep struct {
+	name   string
+	result *TestResult
+}
+
+// reportSteps lists the steps of a run in the order in which they ran, by the name of the step in the JSON result.
+// Journeys are named journeys/<name>.
+func reportSteps(flowsResult *Oauth2FlowsTestResult) []reportStep {
+	var steps []reportStep
+	if flowsResult == nil {
+		return steps
+	}
+
+	value := reflect.ValueOf(flowsResult).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		name := strings.Split(value.Type().Field(i).Tag.Get("json"), ",")[0]
+		switch field := value.Field(i).Interface().(type) {
+		case *TestResult:
+			if field != nil {
+				steps = append(steps, reportStep{name: name, result: field})
+			}
+		case map[string]*TestResult:
+			for _, journey := range sortedKeys(field) {
+				steps = append(steps, reportStep{name: name + "/" + journey, result: field[journey]})
+			}
+		}
+	}
+	return steps
+}
+
+// zoneReport is the part of a report for a single service and zone.
+type zoneReport struct {
+	service string
+	zone    string
+	steps   []reportStep
+}
+
+// zoneReports lists the services and zones of a run, sorted by name.
+func zoneReports(results MultiZoneTestResult) []zoneReport {
+	var reports []zoneReport
+	for service, zones := range results {
+		for zone, flowsResult := range zones {
+			reports = append(reports, zoneReport{service: service, zone: zone, steps: reportSteps(flowsResult)})
+		}
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].service != reports[j].service {
+			return reports[i].service < reports[j].service
+		}
+		return reports[i].zone < reports[j].zone
+	})
+	return reports
+}
+
+// writeReport writes the results of a run in a report format other than JSON.
+func writeReport(w io.Writer, format string, results MultiZoneTestResult) error {
+	switch format {
+	case reportJUnit:
+		return writeJUnitReport(w, results)
+	case reportTAP:
+		return writeTAPReport(w, results)
+	case reportTable:
+		return writeTableReport(w, results)
+	}
+	return fmt.Errorf("unsupported report format '%s'", format)
+}
+
+// failureDetails describes a failed step, as reported in the failure of a JUnit test case and in the diagnostics of
+// a TAP test.
+type failureDetails struct {
+	Error            string `yaml:"error,omitempty"`
+	ErrorDescription string `yaml:"errorDescription,omitempty"`
+	StatusCode       *int   `yaml:"statusCode,omitempty"`
+	FinalURL         string `yaml:"finalUrl,omitempty"`
+	BodyExcerpt      string `yaml:"bodyExcerpt,omitempty"`
+}
+
+func newFailureDetails(result *TestResult) failureDetails {
+	return failureDetails{
+		Error:            result.Error,
+		ErrorDescription: result.ErrorDescription,
+		StatusCode:       result.StatusCode,
+		FinalURL:         result.FinalURL,
+		BodyExcerpt:      result.BodyExcerpt,
+	}
+}
+
+func (details failureDetails) yaml() string {
+	out, err := yaml.Marshal(details)
+	if err != nil {
+		return err.Error()
+	}
+	return string(out)
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr,omitempty"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Error     *junitFailure `xml:"error,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+// writeJUnitReport writes a JUnit XML report: a test suite per service and zone, with a test case per step.
+func writeJUnitReport(w io.Writer, results MultiZoneTestResult) error {
+	report := junitTestSuites{Name: "uaa-smoke-tests"}
+	var total time.Duration
+	for _, zone := range zoneReports(results) {
+		suite := junitTestSuite{Name: zone.service + "/" + zone.zone}
+		var suiteTime time.Duration
+		for _, step := range zone.steps {
+			testCase := junitTestCase{Name: step.name, ClassName: zone.service + "." + zone.zone, Time: junitTime(0)}
+			suite.Tests++
+			if !step.result.Status.ran() {
+				suite.Skipped++
+				testCase.Skipped = &junitSkipped{Message: fmt.Sprintf("%s: %s", step.result.Status, step.result.Reason)}
+				suite.Cases = append(suite.Cases, testCase)
+				continue
+			}
+
+			if suite.Timestamp == "" && !step.result.Started.IsZero() {
+				suite.Timestamp = step.result.Started.UTC().Format("2006-01-02T15:04:05")
+			}
+			suiteTime += step.result.Duration
+			testCase.Time = junitTime(step.result.Duration)
+			switch step.result.Status {
+			case StepFailed:
+				suite.Failures++
+				testCase.Failure = &junitFailure{
+					Message: step.result.Error,
+					Type:    step.result.Error,
+					Text:    newFailureDetails(step.result).yaml(),
+				}
+			case StepErrored:
+				suite.Errors++
+				testCase.Error = &junitFailure{
+					Message: step.result.Reason,
+					Type:    step.result.Error,
+					Text:    newFailureDetails(step.result).yaml(),
+				}
+			}
+			suite.Cases = append(suite.Cases, testCase)
+		}
+		suite.Time = junitTime(suiteTime)
+		report.Tests += suite.Tests
+		report.Failures += suite.Failures
+		report.Errors += suite.Errors
+		report.Skipped += suite.Skipped
+		total += suiteTime
+		report.Suites = append(report.Suites, suite)
+	}
+	report.Time = junitTime(total)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func junitTime(duration time.Duration) string {
+	return fmt.Sprintf("%.3f", duration.Seconds())
+}
+
+// writeTAPReport writes a TAP (version 13) report with a test per step, named service/zone/step. Failed tests carry
+// a YAML diagnostics block; steps that did not run (skipped or disabled) the SKIP directive.
+func writeTAPReport(w io.Writer, results MultiZoneTestResult) error {
+	zones := zoneReports(results)
+	count := 0
+	for _, zone := range zones {
+		count += len(zone.steps)
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "TAP version 13\n1..%d\n", count)
+	number := 0
+	for _, zone := range zones {
+		for _, step := range zone.steps {
+			number++
+			name := fmt.Sprintf("%s/%s/%s", zone.service, zone.zone, step.name)
+			switch {
+			case !step.result.Status.ran():
+				fmt.Fprintf(&out, "ok %d - %s # SKIP %s: %s\n", number, name, step.result.Status, step.result.Reason)
+			case step.result.HasError():
+				fmt.Fprintf(&out, "not ok %d - %s\n  ---\n", number, name)
+				for _, line := range strings.Split(strings.TrimSuffix(newFailureDetails(step.result).yaml(), "\n"), "\n") {
+					fmt.Fprintf(&out, "  %s\n", line)
+				}
+				fmt.Fprintf(&out, "  duration_ms: %d\n  ...\n", step.result.Duration/time.Millisecond)
+			default:
+				fmt.Fprintf(&out, "ok %d - %s\n", number, name)
+			}
+		}
+	}
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// writeTableReport writes a table for people: a line per step with its status, duration and error (or the reason it
+// did not run), followed by the verdict and the number of steps by status.
+func writeTableReport(w io.Writer, results MultiZoneTestResult) error {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "SERVICE\tZONE\tSTEP\tSTATUS\tDURATION\tERROR")
+	summary := StatusSummary{}
+	for _, zone := range zoneReports(results) {
+		for _, step := range zone.steps {
+			summary.count(step.result.Status)
+			duration, errorText := "", step.result.Reason
+			if step.result.Status.ran() && step.result.HasError() {
+				errorText = step.result.Error
+				if step.result.StatusCode != nil {
+					errorText += fmt.Sprintf(" (status %d)", *step.result.StatusCode)
+				}
+				if step.result.ErrorDescription != "" {
+					errorText += ": " + step.result.ErrorDescription
+				}
+			}
+			if step.result.Status.ran() {
+				duration = step.result.Duration.Round(time.Millisecond).String()
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\n", zone.service, zone.zone, step.name, strings.ToUpper(string(step.result.Status)), duration, strings.Replace(errorText, "\n", " ", -1))
+		}
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\n%s: %d passed, %d failed, %d errored, %d skipped, %d disabled\n", strings.ToUpper(string(summary.verdict())), summary.Passed, summary.Failed, summary.Errored, summary.Skipped, summary.Disabled)
+	return err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// scheduler runs the suite continuously: every interval plus a random jitter (so runs of several instances do not
+// align), but never sooner than the minimum gap after the previous run finished.
+type scheduler struct {
+	tests    ssoTests
+	interval time.Duration
+	jitter   time.Duration
+	minGap   time.Duration
+
+	// Steps of the scheduled runs; the configured steps when nil.
+	filter *stepFilter
+}
+
+// The process runs a single scheduler, however often the tests are created.
+var (
+	schedulerMutex   sync.Mutex
+	schedulerStarted bool
+)
+
+// startScheduler starts the scheduler for the given tests when SMOKE_INTERVAL_SECONDS is set, unless a scheduler was
+// started before.
+func startScheduler(tests ssoTests) {
+	schedulerMutex.Lock()
+	defer schedulerMutex.Unlock()
+	if schedulerStarted {
+		return
+	}
+	if scheduler, enabled := schedulerFromEnv(tests); enabled {
+		scheduler.start()
+		schedulerStarted = true
+	}
+}
+
+// schedulerFromEnv creates a scheduler from SMOKE_INTERVAL_SECONDS (no scheduled runs when not set),
+// SMOKE_INTERVAL_JITTER_SECONDS and SMOKE_MIN_GAP_SECONDS. SMOKE_SCHEDULE_INCLUDE_STEPS and
+// SMOKE_SCHEDULE_EXCLUDE_STEPS select the steps of the scheduled runs, when these differ from the configured steps;
+// the runs are not scheduled when they name unknown steps or tags.
+func schedulerFromEnv(tests ssoTests) (*scheduler, bool) {
+	interval := time.Duration(envInt("SMOKE_INTERVAL_SECONDS", 0)) * time.Second
+	if interval <= 0 || len(tests) == 0 {
+		return nil, false
+	}
+	s := &scheduler{
+		tests:    tests,
+		interval: interval,
+		jitter:   time.Duration(envInt("SMOKE_INTERVAL_JITTER_SECONDS", 0)) * time.Second,
+		minGap:   time.Duration(envInt("SMOKE_MIN_GAP_SECONDS", 60)) * time.Second,
+	}
+	include, exclude := envList("SMOKE_SCHEDULE_INCLUDE_STEPS"), envList("SMOKE_SCHEDULE_EXCLUDE_STEPS")
+	if len(include) > 0 || len(exclude) > 0 {
+		filter, err := newStepFilter(include, exclude)
+		if err != nil {
+			logf("Not scheduling smoke tests, invalid step filter: %s", err.Error())
+			return nil, false
+		}
+		s.filter = &filter
+	}
+	return s, true
+}
+
+// start runs the suite in the background until the process exits. The results are kept in the history.
+func (s *scheduler) start() {
+	logf("Running smoke tests every %s (jitter %s, minimum gap %s)", s.interval, s.jitter, s.minGap)
+	go func() {
+		for {
+			started := time.Now()
+			s.tests.runAll(s.filter)
+			time.Sleep(s.wait(time.Since(started)))
+		}
+	}()
+}
+
+// wait returns the time to wait after a run that took the given time.
+func (s *scheduler) wait(elapsed time.Duration) time.Duration {
+	wait := s.interval - elapsed
+	if s.jitter > 0 {
+		wait += time.Duration(randomInt(int(s.jitter/time.Millisecond))) * time.Millisecond
+	}
+	if wait < s.minGap {
+		wait = s.minGap
+	}
+	return wait
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/orangeglasses/cf-uaa-tests/browser"
+)
+
+// SingleSignOn checks that a browser session that logged in with UaaAuthorizationCodeAuthentication is signed on to a
+// second client of the same UAA (the /uaa2Login endpoint of the given client app) without being asked to log in again:
+//
+//   - the session gets a token for the second client straight away (a scope approval page is answered with the given
+//     decision, but no login form may be shown);
+//   - the same holds with prompt=none and max_age, which UAA must answer from the session;
+//   - a new browser session (an empty cookie jar) does get the login form;
+//   - and a new browser session with prompt=none gets the login_required error.
+func SingleSignOn(app clientApp, session *browser.Session, consent consentDecision) (ssoResult TestResult) {
+	ssoResult = defaultTestResult()
+	newSession := browser.NewSession()
+	promptNoneSession := browser.NewSession()
+	defer traceSession(promptNoneSession, 0, &ssoResult)
+	defer traceSession(newSession, 0, &ssoResult)
+	defer traceSession(session, len(session.Hops), &ssoResult)
+
+	loginForm := browser.FormSelector{Fields: []string{"username", "password"}}
+	resourceUrl, callbackUrl := app.url(uaa2ResourcePath), app.url(uaa2CallbackPath)
+
+	// Signed on: no login form.
+	for _, params := range []string{"", "?prompt=none&max_age=3600"} {
+		page, err := session.Get(resourceUrl + params)
+		if err != nil {
+			return ssoResult.failAt(page, "sso_failed", err.Error())
+		}
+		if _, err := page.Form(loginForm); err == nil {
+			return ssoResult.failAt(page, "login_prompted", fmt.Sprintf("Expected a token for the second client (%s%s), but UAA asked to log in again", resourceUrl, params))
+		}
+		if form, found := approvalForm(page); found {
+			if page, err = answerConsent(session, form, consent); err != nil {
+				return ssoResult.failAt(page, "sso_failed", err.Error())
+			}
+		}
+		if _, result := parseCallbackResponse(page, callbackUrl, ssoResult); result.HasError() {
+			result.ErrorDescription = fmt.Sprintf("%s%s: %s", resourceUrl, params, result.ErrorDescription)
+			return result
+		}
+	}
+
+	// Not signed on: login form, or login_required with prompt=none.
+	page, err := newSession.Get(resourceUrl)
+	if err != nil {
+		return ssoResult.failAt(page, "sso_failed", err.Error())
+	}
+	if _, err := page.Form(loginForm); err != nil {
+		return ssoResult.failAt(page, "login_not_prompted", "Expected the login form in a new browser session")
+	}
+	page, err = promptNoneSession.Get(resourceUrl + "?prompt=none")
+	if err != nil {
+		return ssoResult.failAt(page, "sso_failed", err.Error())
+	}
+	_, result := parseCallbackResponse(page, callbackUrl, defaultTestResult())
+	if result.Error != "login_required" {
+		return ssoResult.failAt(page, "login_required_expected", fmt.Sprintf("Expected login_required with prompt=none in a new browser session, got '%s'", result.Error))
+	}
+
+	return ssoResult
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// StepStatus is the outcome of a step of a run.
+type StepStatus string
+
+const (
+	// The step ran and succeeded.
+	StepPassed StepStatus = "passed"
+	// The step ran, but UAA (or ADFS, or the client app) did not respond as expected.
+	StepFailed StepStatus = "failed"
+	// The step could not complete, because a request got no response (e.g. a connection error or a timeout).
+	StepErrored StepStatus = "errored"
+	// The step did not run, because an earlier step failed or errored.
+	StepSkipped StepStatus = "skipped"
+	// The step is not enabled in the configuration.
+	StepDisabled StepStatus = "disabled"
+)
+
+// Error of a step that panicked.
+const errorPanic = "panic"
+
+// ran tells whether a step with this status ran. Steps of a run that is not complete have no status yet.
+func (s StepStatus) ran() bool {
+	return s != StepSkipped && s != StepDisabled
+}
+
+// StatusSummary counts the steps of a run by status.
+type StatusSummary struct {
+	Passed   int `json:"passed"`
+	Failed   int `json:"failed"`
+	Errored  int `json:"errored"`
+	Skipped  int `json:"skipped"`
+	Disabled int `json:"disabled"`
+}
+
+func (s *StatusSummary) count(status StepStatus) {
+	switch status {
+	case StepPassed:
+		s.Passed++
+	case StepFailed:
+		s.Failed++
+	case StepErrored:
+		s.Errored++
+	case StepSkipped:
+		s.Skipped++
+	case StepDisabled:
+		s.Disabled++
+	}
+}
+
+// add adds the counts of another summary.
+func (s *StatusSummary) add(other StatusSummary) {
+	s.Passed += other.Passed
+	s.Failed += other.Failed
+	s.Errored += other.Errored
+	s.Skipped += other.Skipped
+	s.Disabled += other.Disabled
+}
+
+// verdict is the overall outcome of the counted steps: failed when a step failed, errored when a step errored (but
+// none failed) and passed otherwise.
+func (s StatusSummary) verdict() StepStatus {
+	switch {
+	case s.Failed > 0:
+		return StepFailed
+	case s.Errored > 0:
+		return StepErrored
+	}
+	return StepPassed
+}
+
+// stepStatus classifies the result of a step that ran: errored when it panicked or one of its requests got no
+// response, failed on any other error and passed otherwise.
+func stepStatus(result *TestResult) (StepStatus, string) {
+	if !result.HasError() {
+		return StepPassed, ""
+	}
+	if result.Error == errorPanic {
+		return StepErrored, "Panicked: " + result.ErrorDescription
+	}
+	for _, hop := range result.Trace {
+		if hop.Error != "" {
+			return StepErrored, redactText(fmt.Sprintf("No response from %s: %s", hop.URL, hop.Error))
+		}
+	}
+	return StepFailed, ""
+}
+
+// disabledSteps returns the steps that are not enabled in the configuration of this test target, by the name of the
+// step in the JSON result, with the reason.
+func (t *ssoTest) disabledSteps() map[string]string {
+	disabled := make(map[string]string)
+	if !t.mfa {
+		disabled["registerMfa"] = "MFA is not enabled (SMOKE_MFA)"
+		disabled["authCodeUAAInvalidMfa"] = "MFA is not enabled (SMOKE_MFA)"
+	}
+	if !t.checkConsentDenial {
+		disabled["authCodeUAADenied"] = "Denying the scope approval is not checked (SMOKE_CONSENT_CHECK_DENIAL)"
+	}
+	if !t.singleSignOn {
+		disabled["singleSignOn"] = "Single sign-on to a second client is not checked (SMOKE_SSO_SECOND_CLIENT)"
+	}
+	if t.journeysError == nil && len(t.journeys) == 0 {
+		disabled["journeys"] = "No login journeys are configured (SMOKE_JOURNEYS_DIR)"
+	}
+	return disabled
+}
+
+// selection resolves the steps that the filter of a run selects against this test target. Without a client app the
+// browser steps cannot run, so they are deselected with the steps that need them (e.g. the password grants with MFA).
+func (t *ssoTest) selection(filter stepFilter) stepSelection {
+	disabled := t.disabledSteps()
+	selection := filter.resolve(disabled)
+	if t.clientApp == "" {
+		reasons := make(map[string]string)
+		for _, step := range steps {
+			if step.matches(tagBrowser) {
+				reasons[step.name] = fmt.Sprintf("No client app is configured for service '%s' (SMOKE_CLIENT_APPS)", t.serviceName)
+			}
+		}
+		selection.deselect(reasons, disabled)
+	}
+	return selection
+}
+
+// completeResult sets the status of every step of a run and the verdict and summary of the run. Steps that did not
+// run get a result as well: disabled when they were not selected or the configuration does not enable them, skipped
+// (with the last step that failed before them) otherwise.
+func (t *ssoTest) completeResult(flowsResult *Oauth2FlowsTestResult, selection stepSelection) {
+	disabled := t.disabledSteps()
+	for name, reason := range selection {
+		disabled[name] = reason
+	}
+	lastFailure := ""
+	complete := func(name string, result *TestResult) *TestResult {
+		if result == nil {
+			result = &TestResult{Status: StepSkipped, Reason: "Not run"}
+			if lastFailure != "" {
+				result.Reason = fmt.Sprintf("Not run, because %s did not succeed", lastFailure)
+			}
+			if reason, exists := disabled[strings.Split(name, "/")[0]]; exists {
+				result.Status = StepDisabled
+				result.Reason = reason
+			}
+		} else {
+			result.Status, result.Reason = stepStatus(result)
+			if result.HasError() {
+				lastFailure = name
+			}
+		}
+		return result
+	}
+
+	value := reflect.ValueOf(flowsResult).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		name := strings.Split(value.Type().Field(i).Tag.Get("json"), ",")[0]
+		switch field := value.Field(i).Interface().(type) {
+		case *TestResult:
+			value.Field(i).Set(reflect.ValueOf(complete(name, field)))
+		case map[string]*TestResult:
+			// Journeys: the configured journeys that did not run are skipped.
+			if _, isDisabled := disabled[name]; isDisabled {
+				continue
+			}
+			if field == nil {
+				field = make(map[string]*TestResult)
+				value.Field(i).Set(reflect.ValueOf(field))
+			}
+			for _, journey := range t.journeys {
+				if _, exists := field[journey.Name]; !exists {
+					field[journey.Name] = nil
+				}
+			}
+			for _, journey := range sortedKeys(field) {
+				field[journey] = complete(name+"/"+journey, field[journey])
+			}
+		}
+	}
+
+	flowsResult.summarize()
+}
+
+// setStepResult sets the result of a step, by the name of the step in the JSON result, unless the step has a result.
+// A journey that did not complete is reported as journeys/run.
+func (flowsResult *Oauth2FlowsTestResult) setStepResult(name string, result TestResult) {
+	value := reflect.ValueOf(flowsResult).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		if strings.Split(value.Type().Field(i).Tag.Get("json"), ",")[0] != name {
+			continue
+		}
+		switch field := value.Field(i).Interface().(type) {
+		case *TestResult:
+			if field == nil {
+				value.Field(i).Set(reflect.ValueOf(finished(result)))
+			}
+		case map[string]*TestResult:
+			if field == nil {
+				field = make(map[string]*TestResult)
+				value.Field(i).Set(reflect.ValueOf(field))
+			}
+			field["run"] = finished(result)
+		}
+	}
+}
+
+// summarize sets the verdict and summary of a run from the status of its steps.
+func (flowsResult *Oauth2FlowsTestResult) summarize() {
+	summary := StatusSummary{}
+	for _, step := range reportSteps(flowsResult) {
+		summary.count(step.result.Status)
+	}
+	flowsResult.Summary = summary
+	flowsResult.Verdict = summary.verdict()
+}
+
+func sortedKeys(results map[string]*TestResult) []string {
+	var keys []string
+	for key := range results {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Step tags, which select groups of steps in step filters.
+const (
+	tagGrant       = "grant"       // OAuth2 grants
+	tagScim        = "scim"        // user and group management
+	tagBrowser     = "browser"     // logins in a (headless) browser
+	tagAdfs        = "adfs"        // logins via ADFS
+	tagAdmin       = "admin"       // client and zone administration
+	tagDestructive = "destructive" // creates or changes users, groups or clients
+)
+
+// stepDefinition describes a step of the suite: its name in the JSON result, its tags, the steps it needs the results
+// of, the steps it needs only when the configuration enables them (registerMfa with MFA), the step that cleans up
+// what it creates and the authority checks (see adminChecks) it needs.
+type stepDefinition struct {
+	name      string
+	tags      []string
+	dependsOn []string
+	optional  []string
+	cleanup   string
+	checks    []string
+}
+
+// steps lists the steps of the suite in the order in which they run. Cleanup steps run at the end of the run.
+var steps = []stepDefinition{
+	{name: "clientCredentials", tags: []string{tagGrant}},
+	{name: "preflight", tags: []string{tagAdmin}, dependsOn: []string{"clientCredentials"}},
+	{name: "identityProviderInventory", tags: []string{tagAdmin}, dependsOn: []string{"preflight"}, checks: []string{"identityProviders"}},
+	{name: "createUser", tags: []string{tagScim, tagDestructive}, dependsOn: []string{"preflight"}, cleanup: "deleteUser", checks: []string{"passwordPolicy", "createUser"}},
+	{name: "getGroups", tags: []string{tagScim}, dependsOn: []string{"preflight"}, checks: []string{"getGroups"}},
+	{name: "addGroupMemberResult", tags: []string{tagScim, tagDestructive}, dependsOn: []string{"createUser", "getGroups"}, checks: []string{"addGroupMember"}},
+	{name: "registerMfa", tags: []string{tagBrowser}, dependsOn: []string{"createUser"}},
+	{name: "password", tags: []string{tagGrant}, dependsOn: []string{"addGroupMemberResult"}, optional: []string{"registerMfa"}},
+	{name: "createClient", tags: []string{tagAdmin, tagDestructive}, dependsOn: []string{"preflight"}, cleanup: "deleteClient", checks: []string{"createClient"}},
+	{name: "getClient", tags: []string{tagAdmin}, dependsOn: []string{"createClient"}, checks: []string{"getClient"}},
+	{name: "updateClient", tags: []string{tagAdmin, tagDestructive}, dependsOn: []string{"getClient"}, checks: []string{"updateClient"}},
+	{name: "changeClientSecret", tags: []string{tagAdmin, tagDestructive}, dependsOn: []string{"createClient"}, checks: []string{"changeClientSecret"}},
+	{name: "smokeClientCredentials", tags: []string{tagGrant, tagAdmin}, dependsOn: []string{"changeClientSecret"}},
+	{name: "smokeClientPassword", tags: []string{tagGrant, tagAdmin}, dependsOn: []string{"changeClientSecret", "addGroupMemberResult"}, optional: []string{"registerMfa"}},
+	{name: "authCodeUAADenied", tags: []string{tagBrowser}, dependsOn: []string{"addGroupMemberResult"}, optional: []string{"registerMfa"}},
+	{name: "authCodeUAAInvalidMfa", tags: []string{tagBrowser}, dependsOn: []string{"addGroupMemberResult", "registerMfa"}},
+	{name: "authCodeUAA", tags: []string{tagBrowser}, dependsOn: []string{"addGroupMemberResult"}, optional: []string{"registerMfa"}},
+	{name: "tokenLifetimes", tags: []string{tagAdmin}, dependsOn: []string{"authCodeUAA"}, checks: []string{"tokenLifetimes"}},
+	{name: "singleSignOn", tags: []string{tagBrowser}, dependsOn: []string{"authCodeUAA"}},
+	{name: "logoutUAA", tags: []string{tagBrowser}, dependsOn: []string{"authCodeUAA"}},
+	{name: "journeys", tags: []string{tagBrowser}, dependsOn: []string{"addGroupMemberResult"}},
+	{name: "authCodeAdfs", tags: []string{tagBrowser, tagAdfs}},
+	{name: "logoutAdfs", tags: []string{tagBrowser, tagAdfs}, dependsOn: []string{"authCodeAdfs"}},
+	{name: "deleteClient", tags: []string{tagAdmin, tagDestructive}, dependsOn: []string{"createClient"}, checks: []string{"deleteClient"}},
+	{name: "deleteUser", tags: []string{tagScim, tagDestructive}, dependsOn: []string{"createUser"}, checks: []string{"deleteUser"}},
+}
+
+// stepFilter selects the steps of a run by name or tag. Without include filters all steps are included. Steps are
+// named as in the JSON result, case insensitive and with or without dashes (authcode-uaa is authCodeUAA).
+type stepFilter struct {
+	include []string
+	exclude []string
+}
+
+// newStepFilter creates a step filter and checks that it only refers to known steps and tags.
+func newStepFilter(include, exclude []string) (stepFilter, error) {
+	for _, filter := range append(append([]string{}, include...), exclude...) {
+		known := false
+		for _, step := range steps {
+			known = known || step.matches(filter)
+		}
+		if !known {
+			return stepFilter{}, fmt.Errorf("unknown step or tag '%s'", filter)
+		}
+	}
+	return stepFilter{include: include, exclude: exclude}, nil
+}
+
+// stepFilterFromEnv reads the step filter of the service from SMOKE_INCLUDE_STEPS and SMOKE_EXCLUDE_STEPS (comma
+// separated steps and tags).
+func stepFilterFromEnv() (stepFilter, error) {
+	return newStepFilter(envList("SMOKE_INCLUDE_STEPS"), envList("SMOKE_EXCLUDE_STEPS"))
+}
+
+func (step stepDefinition) matches(filter string) bool {
+	filter = normalizeStepName(filter)
+	if filter == normalizeStepName(step.name) || filter == normalizeStepName(strings.TrimSuffix(step.name, "Result")) {
+		return true
+	}
+	for _, tag := range step.tags {
+		if filter == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (step stepDefinition) matchesAny(filters []string) bool {
+	for _, filter := range filters {
+		if step.matches(filter) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeStepName(name string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", "_", "").Replace(name))
+}
+
+// stepSelection holds the steps of a run that are not selected by the step filter, with the reason.
+type stepSelection map[string]string
+
+// resolve selects the steps of a run. The included steps that are not excluded are selected together with the steps
+// they depend on (transitively, unless excluded) and the steps that clean up after them. A step that depends on a step
+// that is not selected is not selected either. Optional dependencies only count when they are not disabled in the
+// configuration (see disabledSteps).
+func (filter stepFilter) resolve(disabled map[string]string) stepSelection {
+	definitions := make(map[string]stepDefinition)
+	notSelected := make(stepSelection)
+	for _, step := range steps {
+		definitions[step.name] = step
+		if step.matchesAny(filter.exclude) {
+			notSelected[step.name] = "Excluded by the step filter"
+		} else if len(filter.include) > 0 && !step.matchesAny(filter.include) {
+			notSelected[step.name] = "Not selected by the step filter"
+		}
+	}
+
+	// Select the dependencies of the selected steps, unless they are excluded.
+	var selectDependencies func(name string)
+	selectDependencies = func(name string) {
+		for _, dependency := range definitions[name].dependencies(disabled) {
+			if notSelected[dependency] == "Not selected by the step filter" {
+				delete(notSelected, dependency)
+				selectDependencies(dependency)
+			}
+		}
+	}
+	for _, step := range steps {
+		if notSelected.selected(step.name) {
+			selectDependencies(step.name)
+		}
+	}
+	notSelected.dropDependents(disabled)
+
+	// Clean up after every selected step.
+	for _, step := range steps {
+		if notSelected.selected(step.name) && step.cleanup != "" {
+			delete(notSelected, step.cleanup)
+		}
+	}
+	return notSelected
+}
+
+// dependencies returns the steps a step needs, including its optional dependencies that are not disabled.
+func (step stepDefinition) dependencies(disabled map[string]string) []string {
+	needed := step.dependsOn
+	for _, dependency := range step.optional {
+		if _, isDisabled := disabled[dependency]; !isDisabled {
+			needed = append(append([]string{}, needed...), dependency)
+		}
+	}
+	return needed
+}
+
+// dropDependents deselects the steps of which a dependency is not selected. Steps run after their dependencies, so a
+// single pass suffices.
+func (selection stepSelection) dropDependents(disabled map[string]string) {
+	for _, step := range steps {
+		for _, dependency := range step.dependencies(disabled) {
+			if selection.selected(step.name) && !selection.selected(dependency) {
+				selection[step.name] = fmt.Sprintf("Needs %s, which is not selected", dependency)
+			}
+		}
+	}
+}
+
+// deselect deselects steps that cannot run, with the reason, during a run (e.g. for lack of an authority), together
+// with the steps that depend on them and the steps that could not be cleaned up after.
+func (selection stepSelection) deselect(reasons map[string]string, disabled map[string]string) {
+	for name, reason := range reasons {
+		if selection.selected(name) {
+			selection[name] = reason
+		}
+	}
+	for _, step := range steps {
+		if selection.selected(step.name) && step.cleanup != "" && !selection.selected(step.cleanup) {
+			selection[step.name] = fmt.Sprintf("Cannot be cleaned up by %s, which does not run", step.cleanup)
+		}
+	}
+	selection.dropDependents(disabled)
+}
+
+// selected tells whether a step runs.
+func (selection stepSelection) selected(name string) bool {
+	_, notSelected := selection[name]
+	return !notSelected
+}
+
+// checks returns the authority checks (see adminChecks) needed by the selected steps.
+func (selection stepSelection) checks() []string {
+	needed := make(map[string]bool)
+	for _, step := range steps {
+		if selection.selected(step.name) {
+			for _, check := range step.checks {
+				needed[check] = true
+			}
+		}
+	}
+	var checks []string
+	for _, check := range adminChecks {
+		if needed[check] {
+			checks = append(checks, check)
+		}
+	}
+	return checks
+}
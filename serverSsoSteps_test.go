@@ -0,0 +1,153 @@
+package main
+
+import "testing"
+
+func TestStepFilterResolve(t *testing.T) {
+	mfaOff := (&ssoTest{}).disabledSteps()
+	mfaOn := (&ssoTest{mfa: true}).disabledSteps()
+
+	tests := []struct {
+		name        string
+		include     []string
+		exclude     []string
+		disabled    map[string]string
+		selected    []string
+		notSelected []string
+	}{
+		{
+			name:        "exclude browser without MFA",
+			exclude:     []string{"browser"},
+			disabled:    mfaOff,
+			selected:    []string{"clientCredentials", "createUser", "addGroupMemberResult", "password", "smokeClientPassword", "deleteUser"},
+			notSelected: []string{"registerMfa", "authCodeUAA", "singleSignOn", "authCodeAdfs"},
+		},
+		{
+			name:        "exclude registerMfa without MFA",
+			exclude:     []string{"register-mfa"},
+			disabled:    mfaOff,
+			selected:    []string{"password", "smokeClientPassword", "authCodeUAA", "tokenLifetimes"},
+			notSelected: []string{"registerMfa", "authCodeUAAInvalidMfa"},
+		},
+		{
+			name:        "exclude browser with MFA",
+			exclude:     []string{"browser"},
+			disabled:    mfaOn,
+			selected:    []string{"createUser", "addGroupMemberResult", "deleteUser"},
+			notSelected: []string{"registerMfa", "password", "smokeClientPassword", "authCodeUAA"},
+		},
+		{
+			name:        "include password with MFA",
+			include:     []string{"password"},
+			disabled:    mfaOn,
+			selected:    []string{"clientCredentials", "preflight", "createUser", "getGroups", "addGroupMemberResult", "registerMfa", "password", "deleteUser"},
+			notSelected: []string{"createClient", "deleteClient", "authCodeUAA"},
+		},
+		{
+			name:        "include password without MFA",
+			include:     []string{"password"},
+			disabled:    mfaOff,
+			selected:    []string{"clientCredentials", "addGroupMemberResult", "password", "deleteUser"},
+			notSelected: []string{"registerMfa", "authCodeUAA"},
+		},
+		{
+			name:        "include adfs",
+			include:     []string{"adfs"},
+			disabled:    mfaOff,
+			selected:    []string{"authCodeAdfs", "logoutAdfs"},
+			notSelected: []string{"clientCredentials", "createUser", "deleteUser"},
+		},
+		{
+			name:        "exclude a dependency of an included step",
+			include:     []string{"tokenLifetimes"},
+			exclude:     []string{"authCodeUAA"},
+			disabled:    mfaOff,
+			notSelected: []string{"authCodeUAA", "tokenLifetimes", "clientCredentials"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := newStepFilter(test.include, test.exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			selection := filter.resolve(test.disabled)
+			for _, step := range test.selected {
+				if !selection.selected(step) {
+					t.Errorf("%s is not selected: %s", step, selection[step])
+				}
+			}
+			for _, step := range test.notSelected {
+				if selection.selected(step) {
+					t.Errorf("%s is selected", step)
+				}
+			}
+		})
+	}
+}
+
+func TestStepFilterResolveReason(t *testing.T) {
+	filter, err := newStepFilter(nil, []string{"registerMfa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	selection := filter.resolve((&ssoTest{mfa: true}).disabledSteps())
+	if reason := selection["password"]; reason != "Needs registerMfa, which is not selected" {
+		t.Errorf("unexpected reason for password: %q", reason)
+	}
+}
+
+func TestSelectionWithoutClientApp(t *testing.T) {
+	noClientApp := "No client app is configured for service 'zone2' (SMOKE_CLIENT_APPS)"
+	tests := []struct {
+		name        string
+		test        *ssoTest
+		selected    []string
+		notSelected map[string]string
+	}{
+		{
+			name:     "without MFA",
+			test:     &ssoTest{serviceName: "zone2"},
+			selected: []string{"clientCredentials", "createUser", "password", "smokeClientPassword", "deleteUser"},
+			notSelected: map[string]string{
+				"authCodeUAA":    noClientApp,
+				"logoutAdfs":     noClientApp,
+				"tokenLifetimes": "Needs authCodeUAA, which is not selected",
+			},
+		},
+		{
+			name:     "with MFA",
+			test:     &ssoTest{serviceName: "zone2", mfa: true},
+			selected: []string{"clientCredentials", "createUser", "smokeClientCredentials", "deleteUser"},
+			notSelected: map[string]string{
+				"registerMfa": noClientApp,
+				"password":    "Needs registerMfa, which is not selected",
+			},
+		},
+		{
+			name:     "with a client app",
+			test:     &ssoTest{serviceName: "zone2", clientApp: defaultClientApp},
+			selected: []string{"authCodeUAA", "tokenLifetimes", "logoutUAA", "authCodeAdfs"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			selection := test.test.selection(test.test.filter)
+			for _, step := range test.selected {
+				if !selection.selected(step) {
+					t.Errorf("%s is not selected: %s", step, selection[step])
+				}
+			}
+			for step, reason := range test.notSelected {
+				if selection[step] != reason {
+					t.Errorf("unexpected reason for %s: %q", step, selection[step])
+				}
+			}
+		})
+	}
+}
+
+func TestNewStepFilterUnknownStep(t *testing.T) {
+	if _, err := newStepFilter([]string{"password", "nonsense"}, nil); err == nil {
+		t.Error("expected an error for an unknown step")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Longest time before its expiry at which a token is renewed. Tokens with a short lifetime are renewed when a fifth
+// of their lifetime is left.
+const tokenRenewalMargin = time.Minute
+
+// TokenSource provides the client credentials token of the bound client to the SCIM and admin helpers. It renews the
+// token shortly before it expires, so a long run does not fail with 401s once its token expired.
+type TokenSource struct {
+	clientID     string
+	clientSecret string
+	authDomain   string
+	log          io.Writer
+
+	mutex sync.Mutex
+	token TokenResponse
+}
+
+func NewTokenSource(clientID, clientSecret, authDomain string) *TokenSource {
+	return &TokenSource{clientID: clientID, clientSecret: clientSecret, authDomain: authDomain, log: logOutput}
+}
+
+// set makes the source use a token that was just fetched (by the client credentials step).
+func (s *TokenSource) set(token TokenResponse) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.token = token
+}
+
+// AccessToken returns a token that is not about to expire, fetching a new one when needed. When no new token can be
+// fetched, it returns the current token, so the request that uses it fails with the error of UAA.
+func (s *TokenSource) AccessToken() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.token.AccessToken != "" && !s.expiring() {
+		return s.token.AccessToken
+	}
+
+	var token TokenResponse
+	result := recovered(func() TestResult {
+		var result TestResult
+		token, result = ClientCredentialsAuthentication(s.clientID, s.clientSecret, s.authDomain)
+		return result
+	})
+	if result.HasError() {
+		fmt.Fprintf(s.log, "Unable to renew the token of client '%s': %s %s\n", s.clientID, result.Error, result.ErrorDescription)
+		return s.token.AccessToken
+	}
+	s.token = token
+	return s.token.AccessToken
+}
+
+// expiring tells whether the token expires within the renewal margin. A token without expiry never expires.
+func (s *TokenSource) expiring() bool {
+	if s.token.Expiry.IsZero() {
+		return false
+	}
+	margin := time.Duration(s.token.ExpiresIn) * time.Second / 5
+	if margin > tokenRenewalMargin {
+		margin = tokenRenewalMargin
+	}
+	return time.Now().Add(margin).After(s.token.Expiry)
+}
+
+// reject drops a token that UAA rejected, so the next call fetches a new one. A token that was already replaced is
+// left alone.
+func (s *TokenSource) reject(accessToken string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.token.AccessToken == accessToken {
+		s.token = TokenResponse{}
+	}
+}
+
+// doWithToken sends a request for a test with a token of the source. When UAA rejects the token (401 invalid_token,
+// e.g. because it expired or was revoked early), the request is sent once more with a new token.
+func doWithToken(request *http.Request, tokens *TokenSource, result *TestResult) (*http.Response, error) {
+	accessToken := tokens.AccessToken()
+	request.Header.Set("Authorization", "Bearer "+accessToken)
+	response, err := do(request, result)
+	if err != nil || !invalidToken(response) {
+		return response, err
+	}
+
+	if err := rewindBody(request); err != nil {
+		return response, nil
+	}
+	response.Body.Close()
+	tokens.reject(accessToken)
+	request.Header.Set("Authorization", "Bearer "+tokens.AccessToken())
+	return do(request, result)
+}
+
+// invalidToken tells whether a response rejects the token of the request.
+func invalidToken(response *http.Response) bool {
+	return response.StatusCode == http.StatusUnauthorized &&
+		strings.Contains(response.Header.Get("WWW-Authenticate"), "invalid_token")
+}
+
+// rewindBody gives a request that was sent a fresh body, to send it again.
+func rewindBody(request *http.Request) error {
+	if request.Body == nil || request.Body == http.NoBody {
+		return nil
+	}
+	if request.GetBody == nil {
+		return fmt.Errorf("the body of %s %s cannot be sent again", request.Method, request.URL)
+	}
+	body, err := request.GetBody()
+	if err != nil {
+		return err
+	}
+	request.Body = body
+	return nil
+}
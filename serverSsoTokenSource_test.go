@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// uaaStub issues tokens named token-1, token-2, ... with the given lifetime, and accepts requests to /Users with the
+// tokens that are not rejected. It counts the issued tokens and keeps the bodies of the requests to /Users.
+type uaaStub struct {
+	mutex     sync.Mutex
+	expiresIn int
+	rejected  map[string]bool
+	issued    int
+	bodies    []string
+}
+
+func (u *uaaStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/oauth/token":
+		u.issued++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": fmt.Sprintf("token-%d", u.issued),
+			"token_type":   "bearer",
+			"expires_in":   u.expiresIn,
+		})
+	case "/Users":
+		body, _ := ioutil.ReadAll(r.Body)
+		u.bodies = append(u.bodies, string(body))
+		if u.rejected[r.Header.Get("Authorization")] {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token", error_description="Token has expired"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"invalid_token","error_description":"Token has expired"}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}
+}
+
+func TestTokenSourceRenewsAheadOfExpiry(t *testing.T) {
+	stub := &uaaStub{expiresIn: 5}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	tokens := NewTokenSource("admin", "secret", server.URL)
+
+	if token := tokens.AccessToken(); token != "token-1" || tokens.AccessToken() != "token-1" {
+		t.Errorf("unexpected token %s", token)
+	}
+
+	// A short-lived token is renewed when a fifth of its lifetime is left, a long-lived one a minute ahead.
+	renewals := []struct {
+		expiresIn int
+		left      time.Duration
+		renewed   bool
+	}{
+		{5, 2 * time.Second, false},
+		{5, 500 * time.Millisecond, true},
+		{3600, 2 * time.Minute, false},
+		{3600, 30 * time.Second, true},
+		{0, 0, false},
+	}
+	for _, renewal := range renewals {
+		token := TokenResponse{AccessToken: "current", ExpiresIn: renewal.expiresIn}
+		if renewal.expiresIn > 0 {
+			token.Expiry = time.Now().Add(renewal.left)
+		}
+		tokens.set(token)
+		if renewed := tokens.AccessToken() != "current"; renewed != renewal.renewed {
+			t.Errorf("token valid for %ds with %s left: renewed %t, expected %t", renewal.expiresIn, renewal.left, renewed, renewal.renewed)
+		}
+	}
+}
+
+func TestDoWithTokenRetriesRejectedToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		rejected map[string]bool
+		status   int
+		attempts int
+		issued   int
+	}{
+		{"accepted", nil, http.StatusCreated, 1, 0},
+		{"rejected once", map[string]bool{"Bearer current": true}, http.StatusCreated, 2, 1},
+		{"rejected again", map[string]bool{"Bearer current": true, "Bearer token-1": true}, http.StatusUnauthorized, 2, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := &uaaStub{expiresIn: 3600, rejected: test.rejected}
+			server := httptest.NewServer(stub)
+			defer server.Close()
+			tokens := NewTokenSource("admin", "secret", server.URL)
+			tokens.set(TokenResponse{AccessToken: "current"})
+
+			body := `{"userName":"smokeuser-test"}`
+			request, _ := http.NewRequest(http.MethodPost, server.URL+"/Users", bytes.NewReader([]byte(body)))
+			result := defaultTestResult()
+			response, err := doWithToken(request, tokens, &result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+
+			if response.StatusCode != test.status {
+				t.Errorf("status %d, expected %d", response.StatusCode, test.status)
+			}
+			if len(stub.bodies) != test.attempts || stub.issued != test.issued {
+				t.Errorf("%d attempts with %d new tokens, expected %d with %d", len(stub.bodies), stub.issued, test.attempts, test.issued)
+			}
+			for i, sent := range stub.bodies {
+				if sent != body {
+					t.Errorf("attempt %d sent %q", i+1, sent)
+				}
+			}
+			if len(result.Trace) != test.attempts {
+				t.Errorf("%d hops in the trace, expected %d", len(result.Trace), test.attempts)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Margin for the time between issuing a token and receiving it, within which expires_in may be lower than the
+	// configured validity.
+	tokenLifetimeMargin = 10 * time.Second
+)
+
+// CheckTokenLifetimes checks that the lifetime of each token (keyed by a name for reporting) matches the
+// access_token_validity of the client it was issued to: the exp and iat claims must be exactly the validity apart and
+// expires_in may only be lower by the time it took to receive the token. Tokens of clients without a configured
+// validity (which get the default of the zone) are only checked for consistency between expires_in and the claims.
+func CheckTokenLifetimes(tokens map[string]TokenResponse, adminTokens *TokenSource, authDomain string, zone IdentityZone) TestResult {
+	lifetimesResult := defaultTestResult()
+
+	var mismatches []string
+	validities := make(map[string]int)
+	var names []string
+	for name := range tokens {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		token := tokens[name]
+		claims, err := decodeAccessToken(token.AccessToken)
+		if err != nil {
+			mismatches = append(mismatches, fmt.Sprintf("%s: %s", name, err.Error()))
+			continue
+		}
+
+		validity, known := validities[claims.ClientID]
+		if !known {
+			client, clientResult := GetClient(claims.ClientID, adminTokens, authDomain, zone)
+			lifetimesResult.Trace = append(lifetimesResult.Trace, clientResult.Trace...)
+			if !clientResult.HasError() && client == nil {
+				clientResult.Result = false
+				clientResult.Error = "client_mismatch"
+				clientResult.ErrorDescription = fmt.Sprintf("Expected client '%s' to be returned", claims.ClientID)
+			}
+			if clientResult.HasError() {
+				clientResult.Started = lifetimesResult.Started
+				clientResult.Trace = lifetimesResult.Trace
+				return clientResult
+			}
+			validity = client.AccessTokenValidity
+			validities[claims.ClientID] = validity
+		}
+
+		lifetime := claims.ExpiresAt - claims.IssuedAt
+		if validity == 0 {
+			// Without a configured validity, the lifetime in the claims is the expected lifetime.
+			validity = int(lifetime)
+		} else if lifetime != int64(validity) {
+			mismatches = append(mismatches, fmt.Sprintf("%s: token of client '%s' is valid for %ds (exp - iat), expected %ds", name, claims.ClientID, lifetime, validity))
+			continue
+		}
+		if token.ExpiresIn > validity || token.ExpiresIn < validity-int(tokenLifetimeMargin.Seconds()) {
+			mismatches = append(mismatches, fmt.Sprintf("%s: expires_in of token of client '%s' is %ds, expected %ds", name, claims.ClientID, token.ExpiresIn, validity))
+		}
+	}
+
+	if len(mismatches) > 0 {
+		lifetimesResult.Result = false
+		lifetimesResult.Error = "token_lifetime_mismatch"
+		lifetimesResult.ErrorDescription = strings.Join(mismatches, "; ")
+	}
+	return lifetimesResult
+}
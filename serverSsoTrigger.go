@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+// trigger starts runs of the suite on request (POST /run), with the steps selected by the include and exclude query
+// parameters (comma separated steps and tags, see stepFilter) or, without them, the configured steps.
+type trigger struct {
+	mutex sync.Mutex
+	tests ssoTests
+}
+
+var runTrigger = &trigger{}
+
+func init() {
+	http.Handle("/run", runTrigger)
+}
+
+// setTests sets the test targets of the triggered runs.
+func (tr *trigger) setTests(tests ssoTests) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	tr.tests = tests
+}
+
+// ServeHTTP runs the suite and responds with its results, in the report format requested by the format query
+// parameter or the Accept header. The run is kept in the history like any other.
+func (tr *trigger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, authError{Error: "method_not_allowed", ErrorDescription: "Start a run with POST"})
+		return
+	}
+	format, supported := reportFormat(r)
+	if !supported {
+		writeJSON(w, http.StatusNotAcceptable, authError{Error: "not_acceptable", ErrorDescription: "Supported formats are json, junit, tap and table"})
+		return
+	}
+
+	tr.mutex.Lock()
+	tests := tr.tests
+	tr.mutex.Unlock()
+	if len(tests) == 0 {
+		writeJSON(w, http.StatusServiceUnavailable, authError{Error: "not_configured", ErrorDescription: "No p-identity services found"})
+		return
+	}
+
+	var results MultiZoneTestResult
+	query := r.URL.Query()
+	include, exclude := splitList(query.Get("include")), splitList(query.Get("exclude"))
+	if len(include) == 0 && len(exclude) == 0 {
+		results = tests.runAll(nil)
+	} else {
+		var err error
+		if results, err = tests.runFiltered(include, exclude); err != nil {
+			writeJSON(w, http.StatusBadRequest, authError{Error: "invalid_request", ErrorDescription: "Invalid step filter: " + err.Error()})
+			return
+		}
+	}
+
+	if format == reportJSON {
+		writeJSON(w, http.StatusOK, results)
+		return
+	}
+	w.Header().Set("Content-Type", reportContentTypes[format])
+	if err := writeReport(w, format, results); err != nil {
+		logf("Unable to write report: %s", err.Error())
+	}
+}
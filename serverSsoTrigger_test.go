@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTriggerRunsWithFilter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"token","token_type":"bearer","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	// The configured filter runs the password grant, which the stub cannot pass.
+	filter, _ := newStepFilter([]string{"password"}, nil)
+	tr := &trigger{}
+	tr.setTests(ssoTests{{serviceName: "sso", authDomain: server.URL, clientId: "admin", clientSecret: "secret", zone: IdentityZone{Subdomain: "uaa"}, filter: filter}})
+
+	requests := []struct {
+		method string
+		query  string
+		status int
+	}{
+		{http.MethodGet, "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "?include=password,unknown", http.StatusBadRequest},
+		{http.MethodPost, "?include=client-credentials&exclude=adfs", http.StatusOK},
+	}
+	for _, request := range requests {
+		recorder := httptest.NewRecorder()
+		tr.ServeHTTP(recorder, httptest.NewRequest(request.method, "/run"+request.query, nil))
+		if recorder.Code != request.status {
+			t.Errorf("%s /run%s: status %d, expected %d: %s", request.method, request.query, recorder.Code, request.status, recorder.Body.String())
+			continue
+		}
+		if recorder.Code != http.StatusOK {
+			continue
+		}
+		var results MultiZoneTestResult
+		if err := json.Unmarshal(recorder.Body.Bytes(), &results); err != nil {
+			t.Fatal(err)
+		}
+		flowsResult := results["sso"]["uaa"]
+		if flowsResult == nil || flowsResult.Verdict != StepPassed || flowsResult.ClientCredentials == nil || flowsResult.Password.Status != StepDisabled {
+			t.Errorf("unexpected results of the filtered run: %s", recorder.Body.String())
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	(&trigger{}).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/run", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d without tests", recorder.Code)
+	}
+}
@@ -5,15 +5,17 @@ import (
 	"encoding/json"
 	"net/http"
 	"fmt"
+	"net/url"
 )
 
-func CreateUser(user ScimUser, jwtToken, authDomain string) (*ScimUser, TestResult) {
+func CreateUser(user ScimUser, tokens *TokenSource, authDomain string, zone IdentityZone) (*ScimUser, TestResult) {
 	createUserResult := defaultTestResult()
 
 	// Marshal user object to JSON bytes.
 	userBytes, err := json.Marshal(user)
 	if err != nil {
-		panic(err)
+		createUserResult.failWith(errorRequestFailed, err)
+		return nil, createUserResult
 	}
 	createUserBody := bytes.NewReader(userBytes)
 
@@ -21,16 +23,17 @@ func CreateUser(user ScimUser, jwtToken, authDomain string) (*ScimUser, TestResu
 	// https://docs.cloudfoundry.org/api/uaa/version/4.7.0/index.html#create-4
 	createUserRequest, err := http.NewRequest(http.MethodPost, authDomain+"/Users", createUserBody)
 	if err != nil {
-		panic(err)
+		createUserResult.failWith(errorRequestFailed, err)
+		return nil, createUserResult
 	}
 	createUserRequest.Header.Add("Accept", "application/json")
 	createUserRequest.Header.Add("Content-Type", "application/json")
-	createUserRequest.Header.Add("Authorization", "Bearer "+jwtToken)
+	zone.addHeaders(createUserRequest)
 
-	httpClient := &http.Client{}
-	createUserResponse, err := httpClient.Do(createUserRequest)
+	createUserResponse, err := doWithToken(createUserRequest, tokens, &createUserResult)
 	if err != nil {
-		panic(err)
+		createUserResult.failWith(errorRequestFailed, err)
+		return nil, createUserResult
 	}
 	defer createUserResponse.Body.Close()
 
@@ -45,7 +48,9 @@ func CreateUser(user ScimUser, jwtToken, authDomain string) (*ScimUser, TestResu
 		var createdUser ScimUser
 		err = json.Unmarshal(responseBuffer.Bytes(), &createdUser)
 		if err != nil {
-			panic(err)
+			createUserResult.StatusCode = &statusCode
+			createUserResult.failWith(errorInvalidResponse, err)
+			return nil, createUserResult
 		}
 		return &createdUser, createUserResult
 	}
@@ -60,22 +65,23 @@ func CreateUser(user ScimUser, jwtToken, authDomain string) (*ScimUser, TestResu
 	return nil, createUserResult
 }
 
-func GetGroups(jwtToken, authDomain string) ([]ScimResource, TestResult) {
+func GetGroups(tokens *TokenSource, authDomain string, zone IdentityZone) ([]ScimResource, TestResult) {
 	getGroupsResult := defaultTestResult()
 
 	// Create request to retrieve all groups.
 	// https://docs.cloudfoundry.org/api/uaa/version/4.7.0/index.html#list-3
 	getGroupsRequest, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/Groups", authDomain), nil)
 	if err != nil {
-		panic(err)
+		getGroupsResult.failWith(errorRequestFailed, err)
+		return nil, getGroupsResult
 	}
 	getGroupsRequest.Header.Add("Accept", "application/json")
-	getGroupsRequest.Header.Add("Authorization", "Bearer "+jwtToken)
+	zone.addHeaders(getGroupsRequest)
 
-	httpClient := &http.Client{}
-	getGroupsResponse, err := httpClient.Do(getGroupsRequest)
+	getGroupsResponse, err := doWithToken(getGroupsRequest, tokens, &getGroupsResult)
 	if err != nil {
-		panic(err)
+		getGroupsResult.failWith(errorRequestFailed, err)
+		return nil, getGroupsResult
 	}
 	defer getGroupsResponse.Body.Close()
 
@@ -86,7 +92,9 @@ func GetGroups(jwtToken, authDomain string) ([]ScimResource, TestResult) {
 	if statusCode == http.StatusOK {
 		var list ScimList
 		if err = json.Unmarshal(responseBuffer.Bytes(), &list); err != nil {
-			panic(err)
+			getGroupsResult.StatusCode = &statusCode
+			getGroupsResult.failWith(errorInvalidResponse, err)
+			return nil, getGroupsResult
 		}
 		return list.Resources, getGroupsResult
 	}
@@ -97,7 +105,7 @@ func GetGroups(jwtToken, authDomain string) ([]ScimResource, TestResult) {
 	return nil, getGroupsResult
 }
 
-func AddGroupMember(groupID, userID, jwtToken, authDomain string) TestResult {
+func AddGroupMember(groupID, userID string, tokens *TokenSource, authDomain string, zone IdentityZone) TestResult {
 	addGroupMemberResult := defaultTestResult()
 
 	// Create request to add a member to a group.
@@ -108,23 +116,25 @@ func AddGroupMember(groupID, userID, jwtToken, authDomain string) TestResult {
 	user["value"] = userID
 	userBytes, err := json.Marshal(user)
 	if err != nil {
-		panic(err)
+		addGroupMemberResult.failWith(errorRequestFailed, err)
+		return addGroupMemberResult
 	}
 	userReader := bytes.NewReader(userBytes)
 
 	addGroupMemberRequest, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/Groups/%s/members", authDomain, groupID), userReader)
 	if err != nil {
-		panic(err)
+		addGroupMemberResult.failWith(errorRequestFailed, err)
+		return addGroupMemberResult
 	}
 	addGroupMemberRequest.Header.Add("Accept", "application/json")
-	addGroupMemberRequest.Header.Add("Authorization", "Bearer "+jwtToken)
 	addGroupMemberRequest.Header.Add("Content-Type", "application/json")
+	zone.addHeaders(addGroupMemberRequest)
 
 	// Perform request.
-	httpClient := &http.Client{}
-	addGroupMemberResponse, err := httpClient.Do(addGroupMemberRequest)
+	addGroupMemberResponse, err := doWithToken(addGroupMemberRequest, tokens, &addGroupMemberResult)
 	if err != nil {
-		panic(err)
+		addGroupMemberResult.failWith(errorRequestFailed, err)
+		return addGroupMemberResult
 	}
 	defer addGroupMemberResponse.Body.Close()
 
@@ -142,23 +152,24 @@ func AddGroupMember(groupID, userID, jwtToken, authDomain string) TestResult {
 	return addGroupMemberResult
 }
 
-func DeleteUser(userID, jwtToken, authDomain string) TestResult {
+func DeleteUser(userID string, tokens *TokenSource, authDomain string, zone IdentityZone) TestResult {
 	deleteUserTestResult := defaultTestResult()
 
 	// Create request to delete user.
 	// https://docs.cloudfoundry.org/api/uaa/version/4.7.0/index.html#delete-3
 	userDeleteRequest, err := http.NewRequest(http.MethodDelete, authDomain+"/Users/"+userID, nil)
 	if err != nil {
-		panic(err)
+		deleteUserTestResult.failWith(errorRequestFailed, err)
+		return deleteUserTestResult
 	}
 	userDeleteRequest.Header.Add("Accept", "application/json")
 	userDeleteRequest.Header.Add("Content-Type", "application/json")
-	userDeleteRequest.Header.Add("Authorization", "Bearer "+jwtToken)
+	zone.addHeaders(userDeleteRequest)
 
-	httpClient := &http.Client{}
-	userDeleteResponse, err := httpClient.Do(userDeleteRequest)
+	userDeleteResponse, err := doWithToken(userDeleteRequest, tokens, &deleteUserTestResult)
 	if err != nil {
-		panic(err)
+		deleteUserTestResult.failWith(errorRequestFailed, err)
+		return deleteUserTestResult
 	}
 	defer userDeleteResponse.Body.Close()
 
@@ -176,3 +187,75 @@ func DeleteUser(userID, jwtToken, authDomain string) TestResult {
 	return deleteUserTestResult
 }
 
+// RemoveGroupMember removes a user from a group.
+func RemoveGroupMember(groupID, userID string, tokens *TokenSource, authDomain string, zone IdentityZone) TestResult {
+	removeGroupMemberResult := defaultTestResult()
+
+	// https://docs.cloudfoundry.org/api/uaa/version/4.7.0/index.html#remove-member
+	removeGroupMemberRequest, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/Groups/%s/members/%s", authDomain, groupID, userID), nil)
+	if err != nil {
+		removeGroupMemberResult.failWith(errorRequestFailed, err)
+		return removeGroupMemberResult
+	}
+	removeGroupMemberRequest.Header.Add("Accept", "application/json")
+	zone.addHeaders(removeGroupMemberRequest)
+
+	removeGroupMemberResponse, err := doWithToken(removeGroupMemberRequest, tokens, &removeGroupMemberResult)
+	if err != nil {
+		removeGroupMemberResult.failWith(errorRequestFailed, err)
+		return removeGroupMemberResult
+	}
+	defer removeGroupMemberResponse.Body.Close()
+
+	statusCode := removeGroupMemberResponse.StatusCode
+	if statusCode != http.StatusOK {
+		removeGroupMemberResult.Result = false
+		removeGroupMemberResult.StatusCode = &statusCode
+		responseBuffer := new(bytes.Buffer)
+		responseBuffer.ReadFrom(removeGroupMemberResponse.Body)
+		removeGroupMemberResult.ParseErrorResponse(responseBuffer)
+	}
+	return removeGroupMemberResult
+}
+
+// FindUsers returns the users of which the user name starts with the given prefix and that have the given origin (e.g.
+// uaa for local users).
+func FindUsers(userNamePrefix, origin string, tokens *TokenSource, authDomain string, zone IdentityZone) ([]ScimResource, TestResult) {
+	findUsersResult := defaultTestResult()
+
+	// https://docs.cloudfoundry.org/api/uaa/version/4.7.0/index.html#list-2
+	query := url.Values{}
+	query.Set("filter", fmt.Sprintf(`userName sw "%s" and origin eq "%s"`, userNamePrefix, origin))
+	findUsersRequest, err := http.NewRequest(http.MethodGet, authDomain+"/Users?"+query.Encode(), nil)
+	if err != nil {
+		findUsersResult.failWith(errorRequestFailed, err)
+		return nil, findUsersResult
+	}
+	findUsersRequest.Header.Add("Accept", "application/json")
+	zone.addHeaders(findUsersRequest)
+
+	findUsersResponse, err := doWithToken(findUsersRequest, tokens, &findUsersResult)
+	if err != nil {
+		findUsersResult.failWith(errorRequestFailed, err)
+		return nil, findUsersResult
+	}
+	defer findUsersResponse.Body.Close()
+
+	responseBuffer := new(bytes.Buffer)
+	responseBuffer.ReadFrom(findUsersResponse.Body)
+	statusCode := findUsersResponse.StatusCode
+	if statusCode == http.StatusOK {
+		var list ScimList
+		if err = json.Unmarshal(responseBuffer.Bytes(), &list); err != nil {
+			findUsersResult.StatusCode = &statusCode
+			findUsersResult.failWith(errorInvalidResponse, err)
+			return nil, findUsersResult
+		}
+		return list.Resources, findUsersResult
+	}
+
+	findUsersResult.Result = false
+	findUsersResult.StatusCode = &statusCode
+	findUsersResult.ParseErrorResponse(responseBuffer)
+	return nil, findUsersResult
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// A response that is not JSON or no response at all fails the step with its trace, instead of ending the run.
+func TestHelpersFailWithoutPanicking(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/oauth/token":
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("<html><body>502 Bad Gateway</body></html>"))
+		case "/Groups":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html><body>Maintenance</body></html>"))
+		case "/Users":
+			<-release
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := httpClient
+	httpClient = &http.Client{Timeout: 50 * time.Millisecond}
+	defer func() { httpClient = client }()
+
+	tokens := NewTokenSource("admin", "secret", server.URL)
+	tokens.set(TokenResponse{AccessToken: "token"})
+
+	_, tokenResult := ClientCredentialsAuthentication("admin", "secret", server.URL)
+	if !tokenResult.HasError() || tokenResult.StatusCode == nil || *tokenResult.StatusCode != http.StatusBadGateway {
+		t.Errorf("unexpected result of the client credentials grant: %+v", tokenResult)
+	}
+
+	_, groupsResult := GetGroups(tokens, server.URL, IdentityZone{})
+	if groupsResult.Error != errorInvalidResponse || len(groupsResult.Trace) != 1 {
+		t.Errorf("unexpected result of getting the groups: %+v", groupsResult)
+	}
+	if status, _ := stepStatus(&groupsResult); status != StepFailed {
+		t.Errorf("unexpected status %s of getting the groups", status)
+	}
+
+	_, createResult := CreateUser(ScimUser{UserName: "smokeuser-test"}, tokens, server.URL, IdentityZone{})
+	if createResult.Error != errorRequestFailed || len(createResult.Trace) != 1 {
+		t.Errorf("unexpected result of creating the user: %+v", createResult)
+	}
+	if status, _ := stepStatus(&createResult); status != StepErrored {
+		t.Errorf("unexpected status %s of creating the user", status)
+	}
+}
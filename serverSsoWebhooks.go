@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Kinds of webhooks.
+	slackWebhook        = "slack"
+	genericWebhook      = "generic"
+	alertmanagerWebhook = "alertmanager"
+
+	// States of a step in notifications.
+	stepFailing   = "failing"
+	stepRecovered = "recovered"
+
+	// Delay before the first retry of a failed delivery; it doubles with every attempt, up to the maximum.
+	webhookInitialBackoff = time.Second
+	webhookMaxBackoff     = time.Minute
+
+	// Number of scheduled runs for which a firing alert lasts in Alertmanager without being repeated.
+	alertmanagerIntervals = 3
+)
+
+// StepNotification reports that a step started failing or recovered.
+type StepNotification struct {
+	Service          string    `json:"service"`
+	Zone             string    `json:"zone"`
+	Step             string    `json:"step"`
+	State            string    `json:"state"`
+	Error            string    `json:"error,omitempty"`
+	ErrorDescription string    `json:"errorDescription,omitempty"`
+	StatusCode       *int      `json:"statusCode,omitempty"`
+	Time             time.Time `json:"time"`
+}
+
+type webhook struct {
+	kind string
+	url  string
+}
+
+// notifier sends notifications to webhooks when the state of a step differs from the last state that was sent for
+// it. A notification that was sent for the same step, state and error within the deduplication window (e.g. of a
+// flapping step) is held back; it is sent by the first run after the window when the step is still in that state.
+// Deliveries that fail are retried with exponential back-off.
+type notifier struct {
+	mutex          sync.Mutex
+	webhooks       []webhook
+	sentState      map[stepKey]string
+	lastSent       map[string]time.Time
+	dedupWindow    time.Duration
+	alertTTL       time.Duration
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	client         *http.Client
+}
+
+var notifications = notifierFromEnv()
+
+// notifierFromEnv configures webhooks from SMOKE_WEBHOOK_SLACK_URLS (Slack incoming webhooks), SMOKE_WEBHOOK_URLS
+// (generic JSON) and SMOKE_WEBHOOK_ALERTMANAGER_URLS (the /api/v2/alerts endpoint of Alertmanager), all comma
+// separated, and SMOKE_WEBHOOK_DEDUP_SECONDS and SMOKE_WEBHOOK_MAX_ATTEMPTS. Firing alerts end after a few scheduled
+// runs (SMOKE_INTERVAL_SECONDS and SMOKE_INTERVAL_JITTER_SECONDS) unless they are repeated.
+func notifierFromEnv() *notifier {
+	n := &notifier{
+		sentState:      make(map[stepKey]string),
+		lastSent:       make(map[string]time.Time),
+		dedupWindow:    time.Duration(envInt("SMOKE_WEBHOOK_DEDUP_SECONDS", 900)) * time.Second,
+		alertTTL:       alertmanagerIntervals * time.Duration(envInt("SMOKE_INTERVAL_SECONDS", 0)+envInt("SMOKE_INTERVAL_JITTER_SECONDS", 0)) * time.Second,
+		maxAttempts:    envInt("SMOKE_WEBHOOK_MAX_ATTEMPTS", 5),
+		initialBackoff: webhookInitialBackoff,
+		maxBackoff:     webhookMaxBackoff,
+		client:         &http.Client{Timeout: 10 * time.Second},
+	}
+	for kind, variable := range map[string]string{
+		slackWebhook:        "SMOKE_WEBHOOK_SLACK_URLS",
+		genericWebhook:      "SMOKE_WEBHOOK_URLS",
+		alertmanagerWebhook: "SMOKE_WEBHOOK_ALERTMANAGER_URLS",
+	} {
+		for _, url := range envList(variable) {
+			n.webhooks = append(n.webhooks, webhook{kind: kind, url: url})
+		}
+	}
+	return n
+}
+
+// record compares the results of a run with the last state sent for every step and notifies the webhooks of steps
+// that started failing or recovered. Steps that did not run keep their state. A step that fails in its first run counts
+// as a transition.
+// Alertmanager is sent every failing step on every run, as it resolves alerts that are not repeated; it deduplicates
+// them itself.
+func (n *notifier) record(results MultiZoneTestResult) {
+	if len(n.webhooks) == 0 {
+		return
+	}
+
+	transitions, failing := n.changes(results, time.Now())
+	for _, hook := range n.webhooks {
+		switch hook.kind {
+		case slackWebhook:
+			for _, notification := range transitions {
+				go n.deliver(hook, slackPayload(notification))
+			}
+		case genericWebhook:
+			for _, notification := range transitions {
+				go n.deliver(hook, notification)
+			}
+		case alertmanagerWebhook:
+			var resolved []StepNotification
+			for _, notification := range transitions {
+				if notification.State == stepRecovered {
+					resolved = append(resolved, notification)
+				}
+			}
+			if len(failing) > 0 || len(resolved) > 0 {
+				go n.deliver(hook, alertmanagerPayload(failing, resolved, n.alertTTL))
+			}
+		}
+	}
+}
+
+// changes returns the notifications of the steps that changed state (see record) and of all failing steps, and
+// records the notifications as sent.
+func (n *notifier) changes(results MultiZoneTestResult, now time.Time) (transitions, failing []StepNotification) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for service, zones := range results {
+		for zone, flowsResult := range zones {
+			for step, result := range stepResults(flowsResult) {
+				key := stepKey{service: service, zone: zone, step: step}
+				notification := StepNotification{Service: service, Zone: zone, Step: step, State: stepRecovered, Time: now}
+				if result.HasError() {
+					notification.State = stepFailing
+					notification.Error = result.Error
+					notification.ErrorDescription = result.ErrorDescription
+					notification.StatusCode = result.StatusCode
+					failing = append(failing, notification)
+				}
+
+				sentState, exists := n.sentState[key]
+				if !exists {
+					sentState = stepRecovered
+				}
+				if sentState == notification.State {
+					continue
+				}
+
+				dedupKey := fmt.Sprintf("%s/%s/%s/%s/%s", service, zone, step, notification.State, notification.Error)
+				if sent, exists := n.lastSent[dedupKey]; exists && now.Sub(sent) < n.dedupWindow {
+					continue
+				}
+				n.sentState[key] = notification.State
+				n.lastSent[dedupKey] = now
+				transitions = append(transitions, notification)
+			}
+		}
+	}
+	sortNotifications(transitions)
+	sortNotifications(failing)
+	return transitions, failing
+}
+
+// deliver posts a payload to a webhook, retrying with exponential back-off until it is accepted (any 2xx status) or
+// the maximum number of attempts is reached.
+func (n *notifier) deliver(hook webhook, payload interface{}) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logf("Unable to create %s webhook payload: %s", hook.kind, err.Error())
+		return
+	}
+
+	backoff := n.initialBackoff
+	for attempt := 1; ; attempt++ {
+		err = n.post(hook.url, body)
+		if err == nil {
+			return
+		}
+		if attempt >= n.maxAttempts {
+			logf("Giving up on %s webhook %s after %d attempts: %s", hook.kind, hook.url, attempt, err.Error())
+			return
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > n.maxBackoff {
+			backoff = n.maxBackoff
+		}
+	}
+}
+
+func (n *notifier) post(url string, body []byte) error {
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Add("Content-Type", "application/json")
+	response, err := n.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// slackPayload formats a notification as a Slack message (https://api.slack.com/messaging/webhooks).
+func slackPayload(notification StepNotification) map[string]string {
+	text := fmt.Sprintf(":white_check_mark: UAA smoke test step `%s` recovered in zone `%s` (service `%s`)", notification.Step, notification.Zone, notification.Service)
+	if notification.State == stepFailing {
+		text = fmt.Sprintf(":red_circle: UAA smoke test step `%s` is failing in zone `%s` (service `%s`): %s", notification.Step, notification.Zone, notification.Service, notification.summary())
+	}
+	return map[string]string{"text": text}
+}
+
+type alertmanagerAlert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	EndsAt      *time.Time        `json:"endsAt,omitempty"`
+}
+
+// alertmanagerPayload formats failing steps as firing alerts and recovered steps as resolved alerts
+// (https://prometheus.io/docs/alerting/latest/clients/). The labels identify the step, so a resolved alert matches the
+// alert that fired; the error is an annotation. Firing alerts end after the given time (when not zero), so they do not
+// resolve between runs that are further apart than the resolve_timeout of Alertmanager.
+func alertmanagerPayload(failing, resolved []StepNotification, ttl time.Duration) []alertmanagerAlert {
+	alerts := []alertmanagerAlert{}
+	labels := func(notification StepNotification) map[string]string {
+		return map[string]string{
+			"alertname": "UaaSmokeTestStepFailing",
+			"service":   notification.Service,
+			"zone":      notification.Zone,
+			"step":      notification.Step,
+		}
+	}
+	for _, notification := range failing {
+		alert := alertmanagerAlert{
+			Labels: labels(notification),
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("UAA smoke test step %s is failing", notification.Step),
+				"description": notification.summary(),
+				"error":       notification.Error,
+			},
+		}
+		if ttl > 0 {
+			endsAt := notification.Time.Add(ttl)
+			alert.EndsAt = &endsAt
+		}
+		alerts = append(alerts, alert)
+	}
+	for _, notification := range resolved {
+		endsAt := notification.Time
+		alerts = append(alerts, alertmanagerAlert{
+			Labels:      labels(notification),
+			Annotations: map[string]string{"summary": fmt.Sprintf("UAA smoke test step %s recovered", notification.Step)},
+			EndsAt:      &endsAt,
+		})
+	}
+	return alerts
+}
+
+// summary describes the failure of a step: error, status code and description.
+func (notification StepNotification) summary() string {
+	summary := notification.Error
+	if notification.StatusCode != nil {
+		summary += fmt.Sprintf(" (status %d)", *notification.StatusCode)
+	}
+	if notification.ErrorDescription != "" {
+		summary += ": " + notification.ErrorDescription
+	}
+	return summary
+}
+
+func sortNotifications(notifications []StepNotification) {
+	sort.Slice(notifications, func(i, j int) bool {
+		a, b := notifications[i], notifications[j]
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		if a.Zone != b.Zone {
+			return a.Zone < b.Zone
+		}
+		return a.Step < b.Step
+	})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func passwordStepResults(failing bool) MultiZoneTestResult {
+	result := defaultTestResult()
+	result.Status = StepPassed
+	if failing {
+		result.Result = false
+		result.Error = "invalid_grant"
+		result.Status = StepFailed
+	}
+	return MultiZoneTestResult{"uaa": {"zone": &Oauth2FlowsTestResult{Password: &result}}}
+}
+
+func TestNotifierSendsHeldBackStateChange(t *testing.T) {
+	n := &notifier{sentState: make(map[stepKey]string), lastSent: make(map[string]time.Time), dedupWindow: 15 * time.Minute}
+	start := time.Now()
+	runs := []struct {
+		after   time.Duration
+		failing bool
+		sent    string
+	}{
+		{0, true, stepFailing},
+		{time.Minute, false, stepRecovered},
+		{2 * time.Minute, true, ""}, // same failure within the window: held back
+		{3 * time.Minute, true, ""},
+		{16 * time.Minute, true, stepFailing}, // still failing after the window
+		{17 * time.Minute, true, ""},
+		{18 * time.Minute, false, stepRecovered},
+		{20 * time.Minute, false, ""},
+	}
+	for i, run := range runs {
+		transitions, _ := n.changes(passwordStepResults(run.failing), start.Add(run.after))
+		sent := ""
+		if len(transitions) > 0 {
+			sent = transitions[0].State
+		}
+		if sent != run.sent {
+			t.Errorf("run %d: sent %q, expected %q", i+1, sent, run.sent)
+		}
+	}
+}
+
+func TestAlertmanagerPayloadEndsFiringAlerts(t *testing.T) {
+	now := time.Now()
+	failing := []StepNotification{{Service: "uaa", Zone: "zone", Step: "password", State: stepFailing, Time: now}}
+	alerts := alertmanagerPayload(failing, nil, 30*time.Minute)
+	if len(alerts) != 1 || alerts[0].EndsAt == nil || !alerts[0].EndsAt.Equal(now.Add(30*time.Minute)) {
+		t.Errorf("unexpected alerts: %+v", alerts)
+	}
+	if alerts := alertmanagerPayload(failing, nil, 0); alerts[0].EndsAt != nil {
+		t.Errorf("firing alert without interval has endsAt %s", alerts[0].EndsAt)
+	}
+}
+
+// webhookServer answers the deliveries with the given statuses in turn (200 when they run out), and reports every
+// delivery on the returned channel.
+func webhookServer(statuses ...int) (*httptest.Server, chan StepNotification) {
+	var mutex sync.Mutex
+	deliveries := make(chan StepNotification, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notification StepNotification
+		json.NewDecoder(r.Body).Decode(&notification)
+		deliveries <- notification
+		mutex.Lock()
+		defer mutex.Unlock()
+		if len(statuses) > 0 {
+			w.WriteHeader(statuses[0])
+			statuses = statuses[1:]
+		}
+	}))
+	return server, deliveries
+}
+
+func testNotifier(url string, maxAttempts int) *notifier {
+	return &notifier{
+		webhooks:       []webhook{{kind: genericWebhook, url: url}},
+		sentState:      make(map[stepKey]string),
+		lastSent:       make(map[string]time.Time),
+		dedupWindow:    15 * time.Minute,
+		maxAttempts:    maxAttempts,
+		initialBackoff: time.Millisecond,
+		maxBackoff:     2 * time.Millisecond,
+		client:         &http.Client{Timeout: time.Second},
+	}
+}
+
+// received waits for the deliveries of asynchronous notifications, until none arrives for a while.
+func received(deliveries chan StepNotification) []StepNotification {
+	var notifications []StepNotification
+	for {
+		select {
+		case notification := <-deliveries:
+			notifications = append(notifications, notification)
+		case <-time.After(200 * time.Millisecond):
+			return notifications
+		}
+	}
+}
+
+func TestNotifierDeliversTransitions(t *testing.T) {
+	server, deliveries := webhookServer()
+	defer server.Close()
+	n := testNotifier(server.URL, 1)
+
+	// A repeated failure is sent once, as is the recovery.
+	for _, failing := range []bool{true, true, true, false, false} {
+		n.record(passwordStepResults(failing))
+	}
+	notifications := received(deliveries)
+	if len(notifications) != 2 {
+		t.Fatalf("unexpected deliveries %+v", notifications)
+	}
+	failing, recovered := notifications[0], notifications[1]
+	if failing.State == stepRecovered {
+		failing, recovered = recovered, failing
+	}
+	if failing.State != stepFailing || failing.Step != "password" || failing.Error != "invalid_grant" {
+		t.Errorf("unexpected failure notification %+v", failing)
+	}
+	if recovered.State != stepRecovered || recovered.Error != "" {
+		t.Errorf("unexpected recovery notification %+v", recovered)
+	}
+}
+
+func TestNotifierRetriesDelivery(t *testing.T) {
+	tests := []struct {
+		name        string
+		statuses    []int
+		maxAttempts int
+		attempts    int
+	}{
+		{"accepted", nil, 3, 1},
+		{"accepted after server errors", []int{http.StatusServiceUnavailable, http.StatusBadGateway}, 3, 3},
+		{"gives up after the maximum attempts", []int{500, 500, 500, 500}, 3, 3},
+		{"accepted with another 2xx status", []int{http.StatusNoContent}, 3, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, deliveries := webhookServer(test.statuses...)
+			defer server.Close()
+			n := testNotifier(server.URL, test.maxAttempts)
+
+			n.deliver(n.webhooks[0], StepNotification{Step: "password", State: stepFailing})
+			if attempts := len(deliveries); attempts != test.attempts {
+				t.Errorf("%d attempts, expected %d", attempts, test.attempts)
+			}
+		})
+	}
+}
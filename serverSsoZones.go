@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IdentityZone identifies the UAA identity zone a test target runs against. Every p-identity service plan maps to
+// an identity zone, whose subdomain is the first label of the auth_domain of the service instance.
+type IdentityZone struct {
+	ID        string `json:"id,omitempty"`
+	Subdomain string `json:"subdomain"`
+
+	// When set, admin requests carry the X-Identity-Zone-Id (or X-Identity-Zone-Subdomain) header, so an admin
+	// client that lives in another zone (typically the default zone) can act on this zone.
+	SwitchHeaders bool `json:"-"`
+}
+
+// addHeaders adds the zone switching headers to an admin request, if enabled.
+// https://docs.cloudfoundry.org/api/uaa/version/4.7.0/index.html#identity-zones
+func (z IdentityZone) addHeaders(request *http.Request) {
+	if !z.SwitchHeaders {
+		return
+	}
+	if z.ID != "" {
+		request.Header.Set("X-Identity-Zone-Id", z.ID)
+	} else if z.Subdomain != "" {
+		request.Header.Set("X-Identity-Zone-Subdomain", z.Subdomain)
+	}
+}
+
+// zoneSubdomain derives the identity zone subdomain from an auth domain, e.g. 'https://rws.login.example.com'
+// gives 'rws'.
+func zoneSubdomain(authDomain string) string {
+	authURL, err := url.Parse(authDomain)
+	if err != nil || authURL.Hostname() == "" {
+		return ""
+	}
+	return strings.SplitN(authURL.Hostname(), ".", 2)[0]
+}
+
+// MultiZoneTestResult holds the result of a full run per bound p-identity service (by service name) and identity
+// zone (by subdomain).
+type MultiZoneTestResult map[string]map[string]*Oauth2FlowsTestResult
+
+var runMutex sync.Mutex
+
+// ssoTests runs the suite against every bound p-identity service instance, one after the other.
+type ssoTests []*ssoTest
+
+func (tests ssoTests) run() interface{} {
+	if len(tests) == 0 {
+		logf("No p-identity services found")
+		return false
+	}
+	return tests.runAll(nil)
+}
+
+// runFiltered runs the suite with the steps that the given include and exclude filters select (see stepFilter),
+// instead of the configured ones. It fails on unknown steps or tags.
+func (tests ssoTests) runFiltered(include, exclude []string) (MultiZoneTestResult, error) {
+	filter, err := newStepFilter(include, exclude)
+	if err != nil {
+		return nil, err
+	}
+	return tests.runAll(&filter), nil
+}
+
+// runAll runs the suite against every zone and records the results in the metrics and the history. Every target
+// runs the steps of its configured filter, unless the run has a filter of its own. Runs never overlap, so the
+// metrics, the history and the notifications follow the order of the runs.
+func (tests ssoTests) runAll(filter *stepFilter) MultiZoneTestResult {
+	runMutex.Lock()
+	defer runMutex.Unlock()
+
+	started := time.Now()
+	results := make(MultiZoneTestResult)
+	for _, t := range tests {
+		t.logf("Running smoke tests against service '%s' (zone '%s')", t.serviceName, t.zone.Subdomain)
+		if _, exists := results[t.serviceName]; !exists {
+			results[t.serviceName] = make(map[string]*Oauth2FlowsTestResult)
+		}
+		runFilter := t.filter
+		if filter != nil {
+			runFilter = *filter
+		}
+		results[t.serviceName][t.zone.Subdomain] = t.runFlows(t.selection(runFilter))
+	}
+	metrics.record(results)
+	notifications.record(results)
+	history.add(started, time.Now(), results)
+	return results
+}